@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rclone/rclone/lib/rest"
+)
+
+// errorResponse is the JSON body teldrive answers failed calls with.
+type errorResponse struct {
+	Message string `json:"message"`
+}
+
+// errorHandler turns a non-2xx response into an error carrying the message
+// of its JSON body, or the raw body when it isn't one.
+func errorHandler(resp *http.Response) error {
+	body, err := rest.ReadBody(resp)
+	if err != nil {
+		return fmt.Errorf("error reading error out of body: %w", err)
+	}
+	var errResp errorResponse
+	if json.Unmarshal(body, &errResp) == nil && errResp.Message != "" {
+		return fmt.Errorf("teldrive: %s (HTTP %d)", errResp.Message, resp.StatusCode)
+	}
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		msg = http.StatusText(resp.StatusCode)
+	}
+	return fmt.Errorf("teldrive: %q (HTTP %d)", msg, resp.StatusCode)
+}
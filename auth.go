@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrAuth is matched by errors of calls the server rejected as unauthorized
+// or forbidden.
+var ErrAuth = errors.New("authentication failed")
+
+// authError is a call rejected with 401 or 403. Its message names the
+// credential to check instead of the response body.
+type authError struct {
+	status     int
+	credential string
+	clockSkew  time.Duration
+	err        error
+}
+
+func (e *authError) Error() string {
+	msg := fmt.Sprintf("your %s is invalid or expired (%s)", e.credential, http.StatusText(e.status))
+	if e.clockSkew != 0 {
+		msg += fmt.Sprintf(", local clock is %v off the server clock", e.clockSkew)
+	}
+	return msg
+}
+
+func (e *authError) Is(target error) bool { return target == ErrAuth }
+
+func (e *authError) Unwrap() error { return e.err }
+
+// checkAuth returns an authError for a 401 or 403 response, or nil.
+func (u *Uploader) checkAuth(resp *http.Response, err error) error {
+	if resp == nil || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+		return nil
+	}
+	credential := "SESSION_TOKEN"
+	if u.bearerAuth {
+		credential = "BEARER_TOKEN"
+	}
+	authErr := &authError{status: resp.StatusCode, credential: credential, err: err}
+	if skew, off := u.clockOff(); off {
+		authErr.clockSkew = skew
+	}
+	return authErr
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// benchmarkWorkers and benchmarkPartSizes are the settings tried by
+// -op benchmark.
+var (
+	benchmarkWorkers   = []int{1, 4, 8}
+	benchmarkPartSizes = []fs.SizeSuffix{4 * fs.Mebi, 16 * fs.Mebi, 64 * fs.Mebi}
+)
+
+// benchmarkRun is the outcome of uploading the benchmark file with one
+// combination of settings.
+type benchmarkRun struct {
+	workers  int
+	partSize int64
+	duration time.Duration
+	err      error
+}
+
+// speed returns the upload speed of the run in bytes per second.
+func (r benchmarkRun) speed(size int64) int64 {
+	return int64(float64(size) / r.duration.Seconds())
+}
+
+// benchmark uploads a file of random data of the given size into destDir
+// with each combination of benchmarkWorkers and benchmarkPartSizes no
+// larger than the file, deleting it after each upload, and prints the
+// speeds and the fastest settings to w.
+func (u *Uploader) benchmark(w io.Writer, destDir string, size int64) error {
+	file, err := os.CreateTemp("", "uploader-benchmark-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := io.CopyN(file, rand.Reader, size); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	// Every run starts over, without resume state or a ramp-up, and uses
+	// the part size it is named after.
+	u.stateDir = ""
+	u.rampUpDuration = 0
+	u.maxParts = 0
+	atomic.StoreInt64(&u.maxPartSize, int64(benchmarkPartSizes[len(benchmarkPartSizes)-1]))
+
+	var runs []benchmarkRun
+	for _, suffix := range benchmarkPartSizes {
+		partSize := int64(suffix)
+		if partSize > size && len(runs) > 0 {
+			break
+		}
+		for _, workers := range benchmarkWorkers {
+			atomic.StoreInt64(&u.partSize, partSize)
+			u.numWorkers = workers
+			u.partSlots = make(chan struct{}, workers)
+
+			name := fmt.Sprintf("uploader-benchmark-w%d-p%v.bin", workers, fs.SizeSuffix(partSize))
+			run := benchmarkRun{workers: workers, partSize: partSize}
+			start := time.Now()
+			info, err := u.uploadRange(file.Name(), name, "application/octet-stream", destDir, u.channelFor(size), 0, size)
+			run.duration, run.err = time.Since(start), err
+			if err == nil && info.Id != "" {
+				if err := u.deleteFile(info.Id); err != nil {
+					Warning.Println("removing benchmark file failed:", name, err)
+				}
+			}
+			runs = append(runs, run)
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKERS\tPART_SIZE\tDURATION\tSPEED")
+	var best *benchmarkRun
+	for i, run := range runs {
+		if run.err != nil {
+			fmt.Fprintf(tw, "%d\t%v\t-\tfailed: %v\n", run.workers, fs.SizeSuffix(run.partSize), run.err)
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%v\t%.1fs\t%v/s\n", run.workers, fs.SizeSuffix(run.partSize), run.duration.Seconds(), fs.SizeSuffix(run.speed(size)))
+		if best == nil || run.speed(size) > best.speed(size) {
+			best = &runs[i]
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if best == nil {
+		return fmt.Errorf("all benchmark uploads failed")
+	}
+	fmt.Fprintf(w, "\nfastest: WORKERS=%d PART_SIZE=%v\n", best.workers, fs.SizeSuffix(best.partSize))
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/rclone/rclone/lib/rest"
+)
+
+// channelBalancer spreads files across several channels. Teldrive doesn't
+// report how full a channel is, so usage is estimated from the bytes this
+// run has assigned to each channel and the least used channel is picked.
+// Files of equal size are therefore assigned round-robin.
+type channelBalancer struct {
+	mu       sync.Mutex
+	channels []int64
+	usage    []int64
+}
+
+func newChannelBalancer(channels []int64) *channelBalancer {
+	return &channelBalancer{
+		channels: channels,
+		usage:    make([]int64, len(channels)),
+	}
+}
+
+// pick returns the channel for a file of the given size and records the
+// size against it.
+func (b *channelBalancer) pick(size int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	best := 0
+	for i := range b.channels {
+		if b.usage[i] < b.usage[best] {
+			best = i
+		}
+	}
+	b.usage[best] += size
+	return b.channels[best]
+}
+
+// channelFor returns the channel a file of the given size is uploaded to.
+func (u *Uploader) channelFor(size int64) int64 {
+	if u.balancer == nil {
+		return u.channelID
+	}
+	return u.balancer.pick(size)
+}
+
+// Channel is a channel listed by the server.
+type Channel struct {
+	ChannelID   int64  `json:"channelId"`
+	ChannelName string `json:"channelName"`
+}
+
+// checkChannels fails when one of channels isn't among the channels of the
+// account, so a wrong id is caught before anything is uploaded. Servers
+// that don't list channels are not checked.
+func (u *Uploader) checkChannels(channels []int64) error {
+	opts := rest.Opts{
+		Method: "GET",
+		Path:   "/api/users/channels",
+	}
+
+	var listed []Channel
+	var resp *http.Response
+	err := u.pacer.Call(func() (bool, error) {
+		var err error
+		resp, err = u.callJSON(u.ctx, &opts, nil, &listed)
+		return u.shouldRetry(u.ctx, resp, err)
+	})
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		Info.Println("server doesn't list channels, not checking channel ids")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("listing channels: %w", err)
+	}
+
+	known := make(map[int64]bool, len(listed))
+	for _, channel := range listed {
+		known[channel.ChannelID] = true
+	}
+	for _, channel := range channels {
+		if !known[channel] {
+			return fmt.Errorf("channel %d not found", channel)
+		}
+	}
+	return nil
+}
+
+// uploadChannels returns the channels files are uploaded to, other than the
+// server default.
+func uploadChannels(config *Config, balance bool) []int64 {
+	if balance {
+		return config.ChannelIDs
+	}
+	if config.ChannelID != 0 {
+		return []int64{config.ChannelID}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// checkClock records the difference between the local clock and the Date
+// header of resp. The first time it exceeds -max-clock-skew a warning is
+// logged, as a wrong clock makes time limited session tokens fail on one
+// machine while they work on others.
+func (u *Uploader) checkClock(resp *http.Response) {
+	if resp == nil || u.maxClockSkew <= 0 {
+		return
+	}
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+
+	skew := time.Since(serverTime).Round(time.Second)
+	atomic.StoreInt64(&u.clockSkew, int64(skew))
+	if skew.Abs() > u.maxClockSkew {
+		u.clockWarning.Do(func() {
+			Warning.Printf("local clock is %v off the server clock, authentication may fail. Sync the system clock", skew)
+		})
+	}
+}
+
+// clockHint adds the clock skew to an authentication error if the clocks
+// are too far apart.
+func (u *Uploader) clockHint(resp *http.Response, err error) error {
+	if resp == nil || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+		return err
+	}
+	if skew, off := u.clockOff(); off {
+		return fmt.Errorf("%w, local clock is %v off the server clock", err, skew)
+	}
+	return err
+}
+
+// clockOff returns the last measured clock skew and whether it is above
+// -max-clock-skew.
+func (u *Uploader) clockOff() (time.Duration, bool) {
+	skew := time.Duration(atomic.LoadInt64(&u.clockSkew))
+	return skew, u.maxClockSkew > 0 && skew.Abs() > u.maxClockSkew
+}
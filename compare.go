@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// compareAction is what to do with a local file after comparing it with the
+// remote file of the same name.
+type compareAction int
+
+const (
+	actionUpload compareAction = iota
+	actionSkip
+	actionOverwrite
+)
+
+// comparator decides whether a local file that already exists remotely
+// should be skipped or uploaded again in place of the remote file.
+// The local file is at path and described by local.
+type comparator interface {
+	compare(path string, local os.FileInfo, remote *FileInfo) (compareAction, error)
+}
+
+// nameComparator treats any remote file with the same name as up to date.
+type nameComparator struct{}
+
+func (nameComparator) compare(path string, local os.FileInfo, remote *FileInfo) (compareAction, error) {
+	return actionSkip, nil
+}
+
+// sizeComparator replaces remote files whose size differs from the local one.
+type sizeComparator struct{}
+
+func (sizeComparator) compare(path string, local os.FileInfo, remote *FileInfo) (compareAction, error) {
+	if local.Size() != remote.Size {
+		return actionOverwrite, nil
+	}
+	return actionSkip, nil
+}
+
+// mtimeComparator replaces remote files that are older than the local one.
+// Remote files without a parsable modification time are compared by size.
+type mtimeComparator struct{}
+
+func (mtimeComparator) compare(path string, local os.FileInfo, remote *FileInfo) (compareAction, error) {
+	modTime, err := time.Parse(time.RFC3339, remote.ModTime)
+	if err != nil {
+		return sizeComparator{}.compare(path, local, remote)
+	}
+	if local.ModTime().Truncate(time.Second).After(modTime) {
+		return actionOverwrite, nil
+	}
+	return actionSkip, nil
+}
+
+// checksumComparator replaces remote files whose SHA-256 hash differs from
+// the hash of the local file. Remote files without a hash, and local files
+// of another size, are compared by size without reading the file.
+type checksumComparator struct{}
+
+func (checksumComparator) compare(path string, local os.FileInfo, remote *FileInfo) (compareAction, error) {
+	if remote.Hash == "" || local.Size() != remote.Size {
+		return sizeComparator{}.compare(path, local, remote)
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return actionUpload, err
+	}
+	if !strings.EqualFold(sum, remote.Hash) {
+		return actionOverwrite, nil
+	}
+	return actionSkip, nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 hash of the file at path,
+// reading it as a stream.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// overwriteComparator replaces every remote file.
+type overwriteComparator struct{}
+
+func (overwriteComparator) compare(path string, local os.FileInfo, remote *FileInfo) (compareAction, error) {
+	return actionOverwrite, nil
+}
+
+// newComparator returns the comparator for a -compare-method value.
+func newComparator(method string) (comparator, error) {
+	switch method {
+	case "name":
+		return nameComparator{}, nil
+	case "size":
+		return sizeComparator{}, nil
+	case "mtime":
+		return mtimeComparator{}, nil
+	case "checksum":
+		return checksumComparator{}, nil
+	case "overwrite":
+		return overwriteComparator{}, nil
+	}
+	return nil, fmt.Errorf("invalid compare method: %s", method)
+}
+
+// findFile returns the file called name in files, or nil.
+func findFile(name string, files []FileInfo) *FileInfo {
+	for i := range files {
+		if files[i].Name == name {
+			return &files[i]
+		}
+	}
+	return nil
+}
+
+// remoteFiles indexes the listing of a remote directory by name, so each
+// local file of a large directory is looked up without scanning it.
+type remoteFiles map[string]*FileInfo
+
+// indexFiles builds the index of files. Of several files with the same
+// name the first is kept, as findFile would return.
+func indexFiles(files []FileInfo) remoteFiles {
+	index := make(remoteFiles, len(files))
+	for i := range files {
+		if _, ok := index[files[i].Name]; !ok {
+			index[files[i].Name] = &files[i]
+		}
+	}
+	return index
+}
+
+// decide compares the local file entry at filePath, uploaded as name, with
+// the listing of its remote directory, returning what to do and the remote
+// file it would replace.
+func (u *Uploader) decide(filePath, name string, entry os.DirEntry, files remoteFiles) (compareAction, *FileInfo, error) {
+	name = u.remoteName(name)
+	if u.checkFileExists(name+manifestSuffix, files) {
+		return actionSkip, nil, nil
+	}
+
+	remote := files[name]
+	if remote == nil {
+		return actionUpload, nil, nil
+	}
+
+	local, err := entry.Info()
+	if err != nil {
+		return actionUpload, nil, err
+	}
+
+	action, err := u.comparator.compare(filePath, local, remote)
+	if err != nil {
+		return actionUpload, nil, err
+	}
+	if action != actionOverwrite {
+		remote = nil
+	}
+	return action, remote, nil
+}
+
+// replacingSuffix is appended to the name of a file while it is uploaded to
+// replace another.
+const replacingSuffix = ".uploading"
+
+// replaceFile deletes the remote file old now that uploaded, stored in
+// destDir as uploadName, replaces it, and renames uploaded to name if that
+// is another name. Should the rename fail, the new copy is left under its
+// temporary name.
+func (u *Uploader) replaceFile(old, uploaded *FileInfo, uploadName, name, destDir string) error {
+	if err := u.deleteFile(old.Id); err != nil {
+		return fmt.Errorf("deleting the replaced %s: %w", name, err)
+	}
+	Info.Println("replaced:", name)
+
+	if uploadName == name {
+		return nil
+	}
+	id := uploaded.Id
+	// Servers may not send the created file back.
+	if id == "" {
+		files, err := u.list(destDir)
+		if err != nil {
+			return fmt.Errorf("renaming %s to %s: %w", uploadName, name, err)
+		}
+		file := findFile(uploadName, files)
+		if file == nil {
+			return fmt.Errorf("renaming %s to %s: file not found", uploadName, name)
+		}
+		id = file.Id
+	}
+	if err := u.updateFile(id, &UpdateFileRequest{Name: name}); err != nil {
+		return fmt.Errorf("renaming %s to %s: %w", uploadName, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// replaceServer is an API that records the file calls of an upload
+// replacing the file with id "old".
+type replaceServer struct {
+	mu       sync.Mutex
+	calls    []string
+	failPart bool
+}
+
+func (s *replaceServer) record(call string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+}
+
+func (s *replaceServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.Method != http.MethodPost {
+			return
+		}
+		if s.failPart {
+			http.Error(w, "bad part", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(UploadPartOut{PartId: 1, PartNo: 1})
+	})
+	mux.HandleFunc("/api/files", func(w http.ResponseWriter, r *http.Request) {
+		var payload FilePayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		s.record("create " + payload.Name)
+		json.NewEncoder(w).Encode(FileInfo{Id: "new", Name: payload.Name, Size: payload.Size})
+	})
+	mux.HandleFunc("/api/files/", func(w http.ResponseWriter, r *http.Request) {
+		var rename UpdateFileRequest
+		json.NewDecoder(r.Body).Decode(&rename)
+		s.record(r.Method + " " + r.URL.Path + " " + rename.Name)
+		w.Write([]byte("{}"))
+	})
+	return mux
+}
+
+func newReplaceUploader(t *testing.T, server *replaceServer) *Uploader {
+	u := newTestUploader(t, context.Background(), server.handler())
+	u.partSize = 1 << 20
+	u.maxPartSize = 1 << 20
+	u.partSlots = make(chan struct{}, 1)
+	u.quiet = true
+	return u
+}
+
+func TestUploadReplacing(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(filePath, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &replaceServer{}
+	u := newReplaceUploader(t, server)
+	result := u.uploadFileAs(filePath, "file.txt", "/", &FileInfo{Id: "old", Name: "file.txt"})
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	want := []string{
+		"create file.txt" + replacingSuffix,
+		"DELETE /api/files/old ",
+		"PATCH /api/files/new file.txt",
+	}
+	if len(server.calls) != len(want) {
+		t.Fatalf("calls %q, want %q", server.calls, want)
+	}
+	for i := range want {
+		if server.calls[i] != want[i] {
+			t.Errorf("call %d is %q, want %q", i, server.calls[i], want[i])
+		}
+	}
+}
+
+func TestUploadReplacingFailed(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(filePath, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &replaceServer{failPart: true}
+	u := newReplaceUploader(t, server)
+	result := u.uploadFileAs(filePath, "file.txt", "/", &FileInfo{Id: "old", Name: "file.txt"})
+	if result.Err == nil {
+		t.Fatal("upload succeeded with a failing part")
+	}
+	if len(server.calls) != 0 {
+		t.Errorf("calls %q after a failed upload, want none", server.calls)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// configFile is the default file the configuration is loaded from.
+const configFile = "upload.env"
+
+// configFlag registers a flag overriding the Config variable env. The value
+// is exported to the environment, so it wins over variables already set and
+// over upload.env, which godotenv never applies over the environment.
+func configFlag(name, env, usage string) {
+	flag.Func(name, usage+", overrides "+env, func(value string) error {
+		return os.Setenv(env, value)
+	})
+}
+
+// writeConfigTemplate creates path with every Config variable, its
+// description and default. Optional variables without a default, other than
+// strings, are commented out, as an empty value doesn't parse for numbers.
+// An existing file is left alone.
+func writeConfigTemplate(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists", path)
+	}
+	if err != nil {
+		return err
+	}
+
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		required := field.Tag.Get("required") == "true"
+		def := field.Tag.Get("default")
+
+		fmt.Fprintf(file, "# %s", field.Tag.Get("desc"))
+		if required {
+			fmt.Fprint(file, " (required)")
+		}
+		fmt.Fprintln(file)
+		if !required && def == "" && field.Type.Kind() != reflect.String {
+			fmt.Fprint(file, "# ")
+		}
+		fmt.Fprintf(file, "%s=%q\n\n", field.Tag.Get("envconfig"), def)
+	}
+	return file.Close()
+}
+
+// printConfig writes the resolved configuration as environment variables,
+// with the tokens redacted.
+func printConfig(w io.Writer, config *Config) {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("envconfig")
+		value := v.Field(i)
+
+		var text string
+		switch {
+		case (name == "SESSION_TOKEN" || name == "BEARER_TOKEN") && value.String() != "":
+			text = "<redacted>"
+		case value.Kind() == reflect.Slice:
+			items := make([]string, value.Len())
+			for j := range items {
+				items[j] = fmt.Sprint(value.Index(j).Interface())
+			}
+			text = strings.Join(items, ",")
+		default:
+			text = fmt.Sprint(value.Interface())
+		}
+		fmt.Fprintf(w, "%s=%q\n", name, text)
+	}
+}
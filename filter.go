@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// pathFilter selects the entries of a directory upload by their path
+// relative to the source root, using rclone style globs: "*.mp4" matches in
+// any directory, "/photos/**" only below the root and "**" crosses
+// directories.
+type pathFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// parseGlobs compiles a comma separated list of globs.
+func parseGlobs(value string) ([]*regexp.Regexp, error) {
+	var globs []*regexp.Regexp
+	for _, glob := range strings.Split(value, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		re, err := filter.GlobToRegexp(glob, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", glob, err)
+		}
+		globs = append(globs, re)
+	}
+	return globs, nil
+}
+
+// newPathFilter returns the filter for the -include and -exclude values, or
+// nil if both are empty.
+func newPathFilter(include, exclude string) (*pathFilter, error) {
+	f := &pathFilter{}
+	var err error
+	if f.include, err = parseGlobs(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = parseGlobs(exclude); err != nil {
+		return nil, err
+	}
+	if len(f.include) == 0 && len(f.exclude) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func matchAny(globs []*regexp.Regexp, name string) bool {
+	for _, re := range globs {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether the entry at relPath is left out. Excludes win
+// over includes. A directory is only left out when it matches an exclude,
+// as pattern "dir/" or "dir", and is then not walked at all. Includes only
+// select files.
+func (f *pathFilter) excluded(relPath string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	if isDir {
+		return matchAny(f.exclude, relPath) || matchAny(f.exclude, relPath+"/")
+	}
+	if matchAny(f.exclude, relPath) {
+		return true
+	}
+	return len(f.include) > 0 && !matchAny(f.include, relPath)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// flatName returns the remote name of the file at relPath in a -flatten
+// upload. It is the file's own name unless an earlier file of the walk took
+// it, then the relative path joined with "_", e.g. a_b_clip.mp4, followed
+// by a counter if that is taken too. Walks visit files in the same order,
+// so a file gets the same name on every run of an unchanged tree.
+func (u *Uploader) flatName(relPath string) string {
+	name := path.Base(relPath)
+	if u.flatNames[name] {
+		name = strings.ReplaceAll(relPath, "/", "_")
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; u.flatNames[name]; i++ {
+		name = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+	u.flatNames[name] = true
+	return name
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"sync"
+)
+
+// contentHasher computes the SHA-256 hash of a file from the reads of its
+// parts. Parts are read concurrently and out of order, so only bytes that
+// continue the hash are taken; bytes read ahead of it are left to sum. With
+// one part at a time the file is hashed without reading it again.
+type contentHasher struct {
+	mu   sync.Mutex
+	hash hash.Hash
+	next int64
+}
+
+func newContentHasher() *contentHasher {
+	return &contentHasher{hash: sha256.New()}
+}
+
+// write hashes the bytes of p read at pos that follow the bytes hashed so
+// far. Bytes hashed already, as read again by a retried part, are ignored.
+func (c *contentHasher) write(pos int64, p []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pos > c.next || pos+int64(len(p)) <= c.next {
+		return
+	}
+	n, _ := c.hash.Write(p[c.next-pos:])
+	c.next += int64(n)
+}
+
+// tee returns a reader of r, which starts at pos in the hashed range, that
+// hashes the bytes read.
+func (c *contentHasher) tee(r io.Reader, pos int64) io.Reader {
+	if c == nil {
+		return r
+	}
+	return &hashingReader{Reader: r, hasher: c, pos: pos}
+}
+
+// sum reads the bytes not hashed from the parts from r, which holds size
+// bytes, and returns the hex encoded hash.
+func (c *contentHasher) sum(r io.ReaderAt, size int64) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.next < size {
+		n, err := io.Copy(c.hash, io.NewSectionReader(r, c.next, size-c.next))
+		c.next += n
+		if err != nil {
+			return "", &localReadError{err}
+		}
+	}
+	return hex.EncodeToString(c.hash.Sum(nil)), nil
+}
+
+type hashingReader struct {
+	io.Reader
+	hasher *contentHasher
+	pos    int64
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.hasher.write(r.pos, p[:n])
+	r.pos += int64(n)
+	return n, err
+}
+
+// logHash logs the hash of an uploaded file in the format of sha256sum, so
+// it can be checked against the local file.
+func logHash(fileName, digest string) {
+	Info.Printf("sha256: %s  %s", digest, fileName)
+}
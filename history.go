@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// historySchema creates the tables -db records runs in.
+const historySchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY,
+	started_at TEXT NOT NULL,
+	finished_at TEXT NOT NULL,
+	source TEXT NOT NULL,
+	dest TEXT NOT NULL,
+	files INTEGER NOT NULL,
+	failed INTEGER NOT NULL,
+	bytes INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS files (
+	run_id INTEGER NOT NULL REFERENCES runs(id),
+	name TEXT NOT NULL,
+	path TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	parts INTEGER NOT NULL,
+	duration_seconds REAL NOT NULL,
+	remote_id TEXT,
+	error TEXT
+);
+CREATE INDEX IF NOT EXISTS files_run_id ON files(run_id);
+`
+
+// openHistory opens the SQLite database at path, creating it and its
+// tables on first use.
+func openHistory(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// recordRun stores a run from source to dest and the result of each of its
+// files. bytes counts the files that were uploaded.
+func recordRun(db *sql.DB, started time.Time, source, dest string, results []UploadResult) error {
+	var failed int
+	var bytes int64
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		} else {
+			bytes += result.Size
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	run, err := tx.Exec(`INSERT INTO runs (started_at, finished_at, source, dest, files, failed, bytes)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		started.UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339),
+		source, dest, len(results), failed, bytes)
+	if err != nil {
+		return err
+	}
+	runID, err := run.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		r := newResultRecord(result)
+		_, err := tx.Exec(`INSERT INTO files (run_id, name, path, size, parts, duration_seconds, remote_id, error)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			runID, r.Name, r.Path, r.Size, r.Parts, r.Duration, nullString(r.RemoteID), nullString(r.Error))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// nullString stores empty strings as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// ignoreFileName is the file at the source root holding ignore rules.
+const ignoreFileName = ".uploadignore"
+
+// ignoreRule is one line of an ignore file.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules are the rules of a .uploadignore file, which uses the
+// .gitignore syntax: "#" starts a comment, "!" re-includes what an earlier
+// rule ignored, a trailing "/" only matches directories and a pattern with
+// a "/" elsewhere is relative to the source root, while one without matches
+// names at any depth. The last matching rule decides.
+type ignoreRules []ignoreRule
+
+// loadIgnoreFile reads the .uploadignore file in dir, if there is one.
+func loadIgnoreFile(dir string) (ignoreRules, error) {
+	file, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules ignoreRules
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") && !strings.HasPrefix(line, "/") && !strings.HasPrefix(line, "**/") {
+			line = "/" + line
+		}
+
+		rule.re, err = filter.GlobToRegexp(line, false)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern %s: %w", ignoreFileName, scanner.Text(), err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// ignored reports whether the entry at relPath, relative to the source
+// root, is ignored.
+func (rules ignoreRules) ignored(relPath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(relPath) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
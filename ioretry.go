@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// ioRetryDelay is the wait before retrying a failed local read, growing with
+// each attempt.
+const ioRetryDelay = 2 * time.Second
+
+// localReadError is an error opening or reading the local file, as opposed
+// to a failed request.
+type localReadError struct {
+	err error
+}
+
+func (e *localReadError) Error() string { return "reading local file: " + e.err.Error() }
+
+func (e *localReadError) Unwrap() error { return e.err }
+
+// localReader marks the errors of reading the local file.
+type localReader struct {
+	io.Reader
+}
+
+func (r localReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = &localReadError{err}
+	}
+	return n, err
+}
+
+// permanentReadError reports whether retrying a local read error is futile
+// because the file is gone or can't be accessed.
+func permanentReadError(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) || errors.Is(err, fs.ErrClosed)
+}
+
+// withIORetries calls fn and retries it up to -io-retries times while it
+// fails reading the local file, so a disk hiccup on a USB drive or network
+// mount doesn't fail the part.
+func (u *Uploader) withIORetries(fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		var readErr *localReadError
+		if !errors.As(err, &readErr) || permanentReadError(err) || attempt > u.ioRetries {
+			return err
+		}
+		Warning.Printf("%v, retrying (%d/%d)", readErr, attempt, u.ioRetries)
+		time.Sleep(time.Duration(attempt) * ioRetryDelay)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// listCache keeps the listing of each remote directory for the run, so a
+// directory is listed once however often it is looked at. Listings are
+// dropped when this run changes the directory, and after ttl if set.
+type listCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]listCacheEntry
+}
+
+type listCacheEntry struct {
+	files  []FileInfo
+	listed time.Time
+}
+
+func newListCache(ttl time.Duration) *listCache {
+	return &listCache{ttl: ttl, entries: map[string]listCacheEntry{}}
+}
+
+// get returns a copy of the cached listing of dir.
+func (c *listCache) get(dir string) ([]FileInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[dir]
+	if !ok || (c.ttl > 0 && time.Since(entry.listed) > c.ttl) {
+		return nil, false
+	}
+	return slices.Clone(entry.files), true
+}
+
+func (c *listCache) put(dir string, files []FileInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[dir] = listCacheEntry{files: slices.Clone(files), listed: time.Now()}
+}
+
+// invalidate drops the listing of dir after a file was created in it.
+func (c *listCache) invalidate(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, dir)
+}
+
+// invalidateAll drops every listing, for changes whose directory isn't known.
+func (c *listCache) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultLockPatterns match lock and temporary files commonly left next to
+// files that are still being written.
+var defaultLockPatterns = []string{"*.lock", "~$*", ".~lock.*", "*.tmp", "*.swp", "*.crdownload"}
+
+// stableChecks is how many times -stable-wait waits for a growing file
+// before giving up on it for this run.
+const stableChecks = 3
+
+// skipLive reports whether filePath should be left out of the upload because
+// it is still being written: with -skip-locked, lock and temporary files and
+// empty placeholders are skipped, and with -stable-wait, files whose size or
+// modification time keep changing are skipped. Files modified longer than
+// -stable-wait ago are uploaded without waiting.
+func (u *Uploader) skipLive(filePath string) (bool, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	if u.skipLocked {
+		for _, pattern := range u.lockPatterns {
+			if ok, _ := filepath.Match(pattern, info.Name()); ok {
+				Info.Println("skipping lock file:", filePath)
+				return true, nil
+			}
+		}
+		if info.Size() == 0 {
+			Info.Println("skipping empty file:", filePath)
+			return true, nil
+		}
+	}
+
+	if u.stableWait <= 0 {
+		return false, nil
+	}
+	for i := 0; i < stableChecks; i++ {
+		// A file not modified for the wait already is stable, only recently
+		// modified files are watched.
+		if time.Since(info.ModTime()) >= u.stableWait {
+			return false, nil
+		}
+		time.Sleep(u.stableWait)
+		now, err := os.Stat(filePath)
+		if err != nil {
+			return false, err
+		}
+		if now.Size() == info.Size() && now.ModTime().Equal(info.ModTime()) {
+			return false, nil
+		}
+		info = now
+	}
+	Warning.Println("skipping file that is still changing:", filePath)
+	return true, nil
+}
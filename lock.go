@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// lockFileName is the remote file used to coordinate uploads from several
+// machines into the same destination.
+const lockFileName = ".uploader.lock"
+
+// lockedError is returned by acquireLock when another uploader holds the lock.
+type lockedError struct {
+	dir   string
+	since string
+}
+
+func (e *lockedError) Error() string {
+	return fmt.Sprintf("%s is locked by another upload since %s", e.dir, e.since)
+}
+
+// acquireLock creates the lock file in destDir, failing with *lockedError if a
+// lock younger than stale is already there. Older locks are assumed to be
+// left behind by a crashed run and are replaced. Two uploaders can both find
+// no lock and create one, so the locks are listed again afterwards and only
+// the oldest one is kept. It returns the id of the created lock file.
+func (u *Uploader) acquireLock(destDir string, stale time.Duration) (string, error) {
+	files, err := u.list(destDir)
+	if err != nil {
+		return "", err
+	}
+
+	locks := findLocks(files)
+	for _, existing := range locks {
+		modTime, err := time.Parse(time.RFC3339, existing.ModTime)
+		if err == nil && time.Since(modTime) < stale {
+			return "", &lockedError{dir: destDir, since: existing.ModTime}
+		}
+	}
+	for _, existing := range locks {
+		Warning.Println("removing stale lock:", destDir, existing.ModTime)
+		if err := u.deleteFile(existing.Id); err != nil {
+			return "", err
+		}
+	}
+
+	host, _ := os.Hostname()
+	content := fmt.Sprintf("host=%s pid=%d time=%s\n", host, os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+
+	// A lock created by another uploader since the listing fails the
+	// creation on servers that keep names unique, others keep both.
+	info, err := u.uploadPayload(&FilePayload{
+		Name:      lockFileName,
+		MimeType:  "text/plain",
+		Path:      destDir,
+		ChannelID: u.channelID,
+		exclusive: true,
+	}, []byte(content))
+
+	files, listErr := u.list(destDir)
+	if listErr != nil {
+		return "", errors.Join(err, listErr)
+	}
+	locks = findLocks(files)
+	if err != nil {
+		if len(locks) > 0 {
+			return "", &lockedError{dir: destDir, since: locks[0].ModTime}
+		}
+		return "", err
+	}
+
+	id := info.Id
+	if id == "" && len(locks) == 1 {
+		id = locks[0].Id
+	}
+	switch {
+	case len(locks) == 0 || id == "":
+		return "", fmt.Errorf("lock file not found after creating it in %s", destDir)
+	case locks[0].Id != id:
+		if err := u.deleteFile(id); err != nil {
+			Warning.Println("removing lock failed:", destDir, err)
+		}
+		return "", &lockedError{dir: destDir, since: locks[0].ModTime}
+	}
+	return id, nil
+}
+
+// keepLock sets the modification time of the lock file id to now every
+// quarter of stale, so that a run longer than stale doesn't have its lock
+// taken as left behind by another. The returned function stops it.
+func (u *Uploader) keepLock(id string, stale time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(stale / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-u.ctx.Done():
+				return
+			case now := <-ticker.C:
+				update := &UpdateFileRequest{ModTime: now.UTC().Format(time.RFC3339)}
+				if err := u.updateFile(id, update); err != nil {
+					Warning.Println("refreshing lock failed:", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// findLocks returns the lock files among files, oldest first.
+func findLocks(files []FileInfo) []FileInfo {
+	var locks []FileInfo
+	for _, file := range files {
+		if file.Name == lockFileName && !isFolder(&file) {
+			locks = append(locks, file)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		if locks[i].ModTime != locks[j].ModTime {
+			return lockTime(locks[i]).Before(lockTime(locks[j]))
+		}
+		return locks[i].Id < locks[j].Id
+	})
+	return locks
+}
+
+// lockTime returns the creation time of a lock file, or the zero time if
+// the server sent none.
+func lockTime(lock FileInfo) time.Time {
+	t, _ := time.Parse(time.RFC3339, lock.ModTime)
+	return t
+}
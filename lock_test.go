@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepLock(t *testing.T) {
+	var refreshes int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/files/lock", func(w http.ResponseWriter, r *http.Request) {
+		var update UpdateFileRequest
+		json.NewDecoder(r.Body).Decode(&update)
+		if r.Method == http.MethodPatch && update.ModTime != "" {
+			atomic.AddInt32(&refreshes, 1)
+		}
+		w.Write([]byte("{}"))
+	})
+	u := newTestUploader(t, context.Background(), mux)
+
+	stop := u.keepLock("lock", 40*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	n := atomic.LoadInt32(&refreshes)
+	if n < 2 {
+		t.Errorf("lock refreshed %d times in 100ms, want at least 2", n)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt32(&refreshes); after != n {
+		t.Errorf("lock refreshed %d times after stopping", after-n)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// colorCodes matches the terminal color codes of the log prefixes, which are
+// left out of log files.
+var colorCodes = regexp.MustCompile("\u001b\\[[0-9;]*m")
+
+// rotatingFile is a log file that is renamed to path.1 once it grows past
+// maxSize, shifting older files up to path.<maxBackups> and removing the
+// oldest. A maxSize of 0 never rotates.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.maxBackups > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	line := colorCodes.ReplaceAll(p, nil)
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logToFile sends the output of all loggers to logConsole and path.
+func logToFile(path string, maxSize int64, maxBackups int) error {
+	file, err := newRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return err
+	}
+	w := io.MultiWriter(logConsole, file)
+	Info.SetOutput(w)
+	Warning.SetOutput(w)
+	Error.SetOutput(w)
+	Debug.SetOutput(w)
+	Summary.SetOutput(w)
+	return nil
+}
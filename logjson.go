@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// jsonLogLine is one line of -log-format json.
+type jsonLogLine struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Caller  string `json:"caller,omitempty"`
+	Message string `json:"msg"`
+	logFields
+}
+
+// logFields are the file, part and bytes a log line is about. They are
+// separate fields in -log-format json and only part of the message in
+// text.
+type logFields struct {
+	File  string `json:"file,omitempty"`
+	Part  int64  `json:"part,omitempty"`
+	Bytes int64  `json:"bytes,omitempty"`
+}
+
+// logWith logs v like logger.Println, with fields in -log-format json.
+func logWith(logger *log.Logger, fields logFields, v ...interface{}) {
+	msg := fmt.Sprintln(v...)
+	w, ok := logger.Writer().(*jsonLogWriter)
+	if !ok {
+		logger.Output(2, msg)
+		return
+	}
+	line := jsonLogLine{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     w.level,
+		Message:   msg[:len(msg)-1],
+		logFields: fields,
+	}
+	if _, file, lineNo, ok := runtime.Caller(1); ok {
+		line.Caller = filepath.Base(file) + ":" + strconv.Itoa(lineNo)
+	}
+	w.write(line)
+}
+
+// jsonLogWriter turns the lines of a logger writing only its caller
+// (log.Lshortfile) into JSON objects of the given level.
+type jsonLogWriter struct {
+	mu    sync.Mutex
+	level string
+	out   io.Writer
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	line := jsonLogLine{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   w.level,
+		Message: string(bytes.TrimSuffix(p, []byte("\n"))),
+	}
+	if caller, msg, ok := bytes.Cut(p, []byte(": ")); ok {
+		line.Caller = string(caller)
+		line.Message = string(bytes.TrimSuffix(msg, []byte("\n")))
+	}
+
+	if err := w.write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *jsonLogWriter) write(line jsonLogLine) error {
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.out.Write(append(b, '\n'))
+	return err
+}
+
+// logJSON switches all loggers to write one JSON object per line, to their
+// current output.
+func logJSON() {
+	for level, loggers := range map[string][]*log.Logger{"info": {Info, Summary}, "warning": {Warning}, "error": {Error}, "debug": {Debug}} {
+		for _, logger := range loggers {
+			logger.SetOutput(&jsonLogWriter{level: level, out: logger.Writer()})
+			logger.SetPrefix("")
+			logger.SetFlags(log.Lshortfile)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLogWithFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&jsonLogWriter{level: "info", out: &buf}, "", log.Lshortfile)
+
+	logWith(logger, logFields{File: "a.bin", Part: 2, Bytes: 1024}, "uploaded:", "a.bin")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"level": "info", "msg": "uploaded: a.bin", "file": "a.bin", "part": 2.0, "bytes": 1024.0}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("%s = %v, want %v", key, line[key], value)
+		}
+	}
+	if caller, _ := line["caller"].(string); !strings.HasPrefix(caller, "logjson_test.go:") {
+		t.Errorf("caller = %q, want logjson_test.go", caller)
+	}
+}
+
+func TestLogWithText(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	logWith(logger, logFields{File: "a.bin"}, "uploaded:", "a.bin")
+
+	if got := buf.String(); got != "uploaded: a.bin\n" {
+		t.Errorf("logged %q, want %q", got, "uploaded: a.bin\n")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+)
+
+// Summary logs the totals at the end of a run. It logs like Info, but is
+// kept by -quiet.
+var Summary = log.New(os.Stdout, "\u001b[34mINFO: \u001B[0m", log.LstdFlags|log.Lshortfile)
+
+// logConsole is where the loggers write to besides a -log-file.
+var logConsole io.Writer = os.Stdout
+
+// logToStderr sends the output of all loggers to stderr instead of stdout.
+func logToStderr() {
+	logConsole = os.Stderr
+	for _, logger := range []*log.Logger{Info, Warning, Error, Debug, Summary} {
+		logger.SetOutput(os.Stderr)
+	}
+}
+
+// logLevels are the values of -log-level, from the most verbose.
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// setLogLevel discards the output of the loggers below level. With
+// keepSummary the Summary logger is left on whatever the level.
+func setLogLevel(level string, keepSummary bool) error {
+	index := slices.Index(logLevels, level)
+	if index < 0 {
+		return fmt.Errorf("invalid log level: %s", level)
+	}
+
+	loggers := [][]*log.Logger{{Debug}, {Info, Summary}, {Warning}, {Error}}
+	for _, below := range loggers[:index] {
+		for _, logger := range below {
+			if logger == Summary && keepSummary {
+				continue
+			}
+			logger.SetOutput(io.Discard)
+		}
+	}
+	return nil
+}
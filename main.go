@@ -1,21 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/rand"
+	"database/sql"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"flag"
@@ -23,11 +30,11 @@ import (
 	"github.com/kelseyhightower/envconfig"
 	"github.com/rclone/rclone/fs"
 	"github.com/rclone/rclone/fs/fserrors"
-	"github.com/rclone/rclone/lib/pacer"
 	"github.com/rclone/rclone/lib/rest"
 
 	"github.com/joho/godotenv"
 	"github.com/schollz/progressbar/v3"
+	"golang.org/x/time/rate"
 )
 
 var Info = log.New(os.Stdout, "\u001b[34mINFO: \u001B[0m", log.LstdFlags|log.Lshortfile)
@@ -39,11 +46,28 @@ var Error = log.New(os.Stdout, "\u001b[31mERROR: \u001b[0m", log.LstdFlags|log.L
 var Debug = log.New(os.Stdout, "\u001b[36mDEBUG: \u001B[0m", log.LstdFlags|log.Lshortfile)
 
 type Config struct {
-	ApiURL       string        `envconfig:"API_URL" required:"true"`
-	SessionToken string        `envconfig:"SESSION_TOKEN" required:"true"`
-	PartSize     fs.SizeSuffix `envconfig:"PART_SIZE"`
-	Workers      int           `envconfig:"WORKERS" default:"4"`
-	ChannelID    int64         `envconfig:"CHANNEL_ID"`
+	ApiURL       string        `envconfig:"API_URL" required:"true" desc:"Url of the hosted teldrive app"`
+	SessionToken string        `envconfig:"SESSION_TOKEN" desc:"User session token, fetched from the teldrive app cookies"`
+	AuthMode     string        `envconfig:"AUTH_MODE" default:"cookie" desc:"How requests are authenticated: cookie with SESSION_TOKEN or bearer with BEARER_TOKEN"`
+	BearerToken  string        `envconfig:"BEARER_TOKEN" desc:"Token sent in an Authorization: Bearer header with AUTH_MODE bearer"`
+	RefreshURL   string        `envconfig:"REFRESH_URL" desc:"Endpoint POSTed to for a new token when a call fails with 401, relative to API_URL or absolute"`
+	RefreshField string        `envconfig:"REFRESH_TOKEN_FIELD" default:"token" desc:"JSON field of the REFRESH_URL response holding the new token, when it sets no user-session cookie"`
+	PartSize     fs.SizeSuffix `envconfig:"PART_SIZE" default:"1000M" desc:"Size of each uploaded part, same as rclone size format"`
+	MaxPartSize  fs.SizeSuffix `envconfig:"MAX_PART_SIZE" default:"2000M" desc:"Largest part size used to keep a file within -max-parts parts"`
+	Workers      int           `envconfig:"WORKERS" default:"4" desc:"Number of parts uploaded at once, 0 for two per CPU"`
+	ChannelID    int64         `envconfig:"CHANNEL_ID" desc:"Channel ID where files are saved, the default set in the UI if empty"`
+	RetryCodes   []int         `envconfig:"RETRY_STATUS_CODES" desc:"Comma separated HTTP status codes to retry, replaces the default 429,500,502,503,504,509"`
+	ChannelIDs   []int64       `envconfig:"CHANNEL_IDS" desc:"Comma separated channel IDs used with -channel-balance"`
+	RemoteRoot   string        `envconfig:"REMOTE_ROOT" desc:"Remote directory that -dest is relative to, e.g. /backups"`
+	FileWorkers  int           `envconfig:"FILE_WORKERS" default:"1" desc:"Number of files of a directory uploaded at once"`
+	LockPatterns []string      `envconfig:"LOCK_PATTERNS" desc:"Comma separated name patterns skipped by -skip-locked, replaces the default *.lock,~$*,.~lock.*,*.tmp,*.swp,*.crdownload"`
+	Timeout      time.Duration `envconfig:"TIMEOUT" default:"1m" desc:"Time limit for each API call other than part uploads, 0 for none"`
+	PartTimeout  time.Duration `envconfig:"PART_TIMEOUT" default:"1h" desc:"Time limit for uploading each part, 0 for none"`
+	PacerMin     time.Duration `envconfig:"PACER_MIN_SLEEP" default:"400ms" desc:"Shortest wait between API calls"`
+	PacerMax     time.Duration `envconfig:"PACER_MAX_SLEEP" default:"5s" desc:"Longest wait before retrying a failed API call"`
+	PacerDecay   uint          `envconfig:"PACER_DECAY" default:"2" desc:"How fast the wait shrinks back after successful calls, higher is slower"`
+	PacerAttack  uint          `envconfig:"PACER_ATTACK" default:"0" desc:"How fast the wait grows after failed calls, 0 waits PACER_MAX_SLEEP right away"`
+	PacerJitter  float64       `envconfig:"PACER_JITTER" default:"0.5" desc:"Share of each retry wait, 0 to 1, taken off at random so parallel retries spread out"`
 }
 
 type UploadPartOut struct {
@@ -54,6 +78,9 @@ type UploadPartOut struct {
 	TotalParts int    `json:"totalParts"`
 	ChannelID  int64  `json:"channelId"`
 	Size       int64  `json:"size"`
+	// File is set by servers that assemble the file themselves once its
+	// last part arrives.
+	File *FileInfo `json:"file,omitempty"`
 }
 
 type Part struct {
@@ -62,19 +89,32 @@ type Part struct {
 }
 
 type FilePayload struct {
-	Name      string `json:"name"`
-	Type      string `json:"type"`
-	Parts     []Part `json:"parts,omitempty"`
-	MimeType  string `json:"mimeType"`
-	Path      string `json:"path"`
-	Size      int64  `json:"size"`
-	ChannelID int64  `json:"channelId"`
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Parts     []Part   `json:"parts,omitempty"`
+	MimeType  string   `json:"mimeType"`
+	Path      string   `json:"path"`
+	Size      int64    `json:"size"`
+	ChannelID int64    `json:"channelId"`
+	Category  string   `json:"category,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	ModTime   string   `json:"updatedAt,omitempty"`
+	Hash      string   `json:"hash,omitempty"`
+
+	// exclusive fails the creation on 409 Conflict instead of taking an
+	// existing file of the same name and size as this one.
+	exclusive bool
 }
 
 type CreateDirRequest struct {
 	Path string `json:"path"`
 }
 
+type UpdateFileRequest struct {
+	Name    string `json:"name,omitempty"`
+	ModTime string `json:"updatedAt,omitempty"`
+}
+
 type MetadataRequestOptions struct {
 	PerPage       uint64
 	SearchField   string
@@ -90,6 +130,7 @@ type FileInfo struct {
 	ParentId string `json:"parentId"`
 	Type     string `json:"type"`
 	ModTime  string `json:"updatedAt"`
+	Hash     string `json:"hash,omitempty"`
 }
 
 type ReadMetadataResponse struct {
@@ -97,13 +138,85 @@ type ReadMetadataResponse struct {
 	NextPageToken string     `json:"nextPageToken,omitempty"`
 }
 
+// queuedFile is a file found by the walk whose upload has been deferred so
+// that files can be uploaded in priority order.
+type queuedFile struct {
+	path    string
+	name    string
+	destDir string
+	modTime time.Time
+	replace *FileInfo
+}
+
 type Uploader struct {
-	http       *rest.Client
-	numWorkers int
-	partSize   int64
-	channelID  int64
-	pacer      *fs.Pacer
-	ctx        context.Context
+	http           *rest.Client
+	numWorkers     int
+	partSize       int64
+	maxPartSize    int64
+	maxParts       int64
+	channelID      int64
+	pacer          *fs.Pacer
+	ctx            context.Context
+	sourceRoot     string
+	startAfter     string
+	started        bool
+	priority       string
+	queue          []queuedFile
+	maxFileSize    int64
+	balancer       *channelBalancer
+	strict         bool
+	bandwidth      *bandwidthLimiter
+	keepSession    bool
+	sessionKeyMode string
+	partNaming     string
+	dirCache       *listCache
+	quiet          bool
+	sanitize       bool
+	sanitizeChar   string
+	maxDepth       int
+	walkers        int
+	walkMu         sync.Mutex
+	flatten        bool
+	flatNames      map[string]bool
+	followSymlinks bool
+	walkedDirs     map[string]bool
+	sessionSalt    string
+	fileLimitHint  sync.Once
+	heldSlots      int32
+	comparator     comparator
+	destRoot       string
+	routes         []mimeRoute
+	skipLocked     bool
+	lockPatterns   []string
+	stableWait     time.Duration
+	verifyChannel  bool
+	progress       *progressSink
+	rampUpDuration time.Duration
+	runStart       time.Time
+	stateDir       string
+	category       string
+	tags           []string
+	extTags        map[string][]string
+	fileWorkers    int
+	partSlots      chan struct{}
+	dryRun         bool
+	maxClockSkew   time.Duration
+	clockSkew      int64
+	clockWarning   sync.Once
+	selectCommand  string
+	selectTimeout  time.Duration
+	verify         bool
+	hashing        bool
+	ioRetries      int
+	filter         *pathFilter
+	minSpeed       int64
+	minSpeedWindow time.Duration
+	timeout        time.Duration
+	refresher      *sessionRefresher
+	bearerAuth     bool
+	partTimeout    time.Duration
+	total          *totalProgress
+	ignore         ignoreRules
 }
 
 var retryErrorCodes = []int{
@@ -115,29 +228,133 @@ var retryErrorCodes = []int{
 	509, // Bandwidth Limit Exceeded
 }
 
-func shouldRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+// strictAttempts is how many times a file is uploaded in strict mode before
+// giving up on a server that keeps assembling it with the wrong size.
+const strictAttempts = 3
+
+var errPartialFile = errors.New("remote file size mismatch")
+
+// minPartSize is the smallest part size a file is retried with after the
+// server rejects its parts as too large.
+const minPartSize = 1 << 20
+
+var errPartTooLarge = errors.New("part too large for server")
+
+// shouldRetry reports whether a failed call is retried. A 401 response is
+// retried once the session has been refreshed, when REFRESH_URL is set.
+// Otherwise 401 and 403 responses fail right away with an ErrAuth error.
+func (u *Uploader) shouldRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
 	if fserrors.ContextError(ctx, &err) {
 		return false, err
 	}
+	if resp != nil && resp.StatusCode == http.StatusUnauthorized && u.refresher != nil && u.refresher.refresh(ctx, u.http) {
+		return true, err
+	}
+	if authErr := u.checkAuth(resp, err); authErr != nil {
+		return false, authErr
+	}
 	return fserrors.ShouldRetry(err) || fserrors.ShouldRetryHTTP(resp, retryErrorCodes), err
 }
 
-func loadConfigFromEnv() (*Config, error) {
+// newRequestID returns a random id used to correlate a request with the
+// server logs.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// callJSON makes an API call tagged with a fresh X-Request-ID header. The id
+// is included in any returned error so that a failure can be matched with
+// the corresponding server log entry. The call is bounded by TIMEOUT.
+func (u *Uploader) callJSON(ctx context.Context, opts *rest.Opts, request interface{}, response interface{}) (*http.Response, error) {
+	return u.callJSONTimeout(ctx, u.timeout, opts, request, response)
+}
 
-	var config Config
+// callJSONTimeout is callJSON with a time limit of its own, 0 for none. A
+// call that times out is retried like a failed connection.
+func (u *Uploader) callJSONTimeout(ctx context.Context, timeout time.Duration, opts *rest.Opts, request interface{}, response interface{}) (*http.Response, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-	err := godotenv.Load("upload.env")
+	requestID := newRequestID()
+
+	opts = opts.Copy()
+	headers := map[string]string{"X-Request-ID": requestID}
+	for k, v := range opts.ExtraHeaders {
+		headers[k] = v
+	}
+	opts.ExtraHeaders = headers
+
+	resp, err := u.http.CallJSON(ctx, opts, request, response)
+	u.checkClock(resp)
 	if err != nil {
-		return nil, err
+		err = fmt.Errorf("%w (request id %s)", u.clockHint(resp, err), requestID)
+	}
+	return resp, err
+}
+
+func loadConfigFromEnv(envFile string) (*Config, error) {
+
+	var config Config
+
+	// The default upload.env is optional, the process environment may hold
+	// everything. A file named with -env-file must exist.
+	err := godotenv.Load(envFile)
+	if errors.Is(err, os.ErrNotExist) && envFile != configFile {
+		return nil, fmt.Errorf("env file %s not found", envFile)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading %s: %w", envFile, err)
 	}
 
 	err = envconfig.Process("", &config)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	if config.PartSize == 0 {
 		config.PartSize = 1000 * fs.Mebi
 	}
+	switch config.AuthMode {
+	case "cookie":
+		if config.SessionToken == "" || config.BearerToken != "" {
+			return nil, errors.New("AUTH_MODE cookie needs SESSION_TOKEN and no BEARER_TOKEN")
+		}
+	case "bearer":
+		if config.BearerToken == "" || config.SessionToken != "" {
+			return nil, errors.New("AUTH_MODE bearer needs BEARER_TOKEN and no SESSION_TOKEN")
+		}
+	default:
+		return nil, fmt.Errorf("invalid auth mode: %s", config.AuthMode)
+	}
+	if config.Workers < 0 {
+		return nil, fmt.Errorf("invalid workers: %d", config.Workers)
+	}
+	if config.FileWorkers < 1 {
+		return nil, fmt.Errorf("invalid file workers: %d", config.FileWorkers)
+	}
+	if config.MaxPartSize < config.PartSize {
+		return nil, fmt.Errorf("invalid max part size: %v is smaller than PART_SIZE %v", config.MaxPartSize, config.PartSize)
+	}
+	if config.Timeout < 0 || config.PartTimeout < 0 {
+		return nil, fmt.Errorf("invalid timeout: %v", min(config.Timeout, config.PartTimeout))
+	}
+	if config.PacerMin <= 0 || config.PacerMax < config.PacerMin {
+		return nil, fmt.Errorf("invalid pacer sleep: %v to %v", config.PacerMin, config.PacerMax)
+	}
+	if config.PacerJitter < 0 || config.PacerJitter > 1 {
+		return nil, fmt.Errorf("invalid pacer jitter: %v", config.PacerJitter)
+	}
+	for _, code := range config.RetryCodes {
+		if code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid retry status code: %d", code)
+		}
+	}
 
 	return &config, nil
 }
@@ -145,49 +362,276 @@ func loadConfigFromEnv() (*Config, error) {
 type ProgressReader struct {
 	io.Reader
 	Reporter func(r int64)
+	Limiter  *rate.Limiter
+	// Ctx ends waits for the Limiter, context.Background if nil.
+	Ctx context.Context
 }
 
 func (pr *ProgressReader) Read(p []byte) (n int, err error) {
+	if pr.Limiter != nil && pr.Limiter.Limit() != rate.Inf && len(p) > pr.Limiter.Burst() {
+		p = p[:pr.Limiter.Burst()]
+	}
 	n, err = pr.Reader.Read(p)
+	if pr.Limiter != nil && n > 0 {
+		ctx := pr.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if werr := pr.wait(ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
 	pr.Reporter(int64(n))
 	return
 }
 
-func (u *Uploader) uploadFile(filePath string, destDir string) error {
+// wait takes n bytes from the Limiter in steps no larger than its burst. A
+// step is taken again if the bandwidth timetable changed the limit while it
+// waited and it exceeds the new burst.
+func (pr *ProgressReader) wait(ctx context.Context, n int) error {
+	for n > 0 {
+		step := n
+		if pr.Limiter.Limit() != rate.Inf {
+			step = min(step, pr.Limiter.Burst())
+		}
+		if err := pr.Limiter.WaitN(ctx, step); err != nil {
+			if ctx.Err() == nil && (pr.Limiter.Limit() == rate.Inf || step > pr.Limiter.Burst()) {
+				continue
+			}
+			return err
+		}
+		n -= step
+	}
+	return nil
+}
+
+// UploadResult describes the outcome of uploading a single file.
+type UploadResult struct {
+	Name     string
+	Path     string
+	Size     int64
+	Parts    int
+	Duration time.Duration
+	RemoteID string
+	SHA256   string
+	Err      error
+}
+
+// uploadFile uploads filePath into destDir and reports the outcome.
+func (u *Uploader) uploadFile(filePath string, destDir string) UploadResult {
+	return u.uploadFileAs(filePath, filepath.Base(filePath), destDir, nil)
+}
+
+// uploadFileAs uploads filePath into destDir under the remote name fileName,
+// replacing the remote file replace if it isn't nil.
+func (u *Uploader) uploadFileAs(filePath, fileName, destDir string, replace *FileInfo) UploadResult {
+	remote := u.remoteName(fileName)
+	logRenamed(fileName, remote)
+	fileName = remote
+
+	result := UploadResult{
+		Name: fileName,
+		Path: filePath,
+	}
+	if u.dryRun {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		result.Size = info.Size()
+		result.Parts = int(u.partCount(info.Size()))
+		if replace != nil {
+			Info.Println("would replace:", replace.Name)
+		}
+		Info.Println("would upload:", filePath, "to", destDir)
+		return result
+	}
+
+	start := time.Now()
+	result.Err = u.upload(filePath, fileName, destDir, replace, &result)
+	result.Duration = time.Since(start)
+	u.reportResult(result)
+	u.total.fileDone(0)
+	return result
+}
+
+func (u *Uploader) upload(filePath, fileName, destDir string, replace *FileInfo, result *UploadResult) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	buffer := make([]byte, 512)
-	_, err = file.Read(buffer)
+	mimeType, err := readMimeType(file)
 	if err != nil {
-		Error.Println("Error reading file:", err)
-		return nil
+		return fmt.Errorf("reading %s: %w", filePath, err)
 	}
 
-	mimeType := http.DetectContentType(buffer)
-
 	fileInfo, _ := file.Stat()
 	fileSize := fileInfo.Size()
-	fileName := filepath.Base(filePath)
-	input := fmt.Sprintf("%s:%s:%d", fileName, destDir, fileSize)
 
-	hash := md5.Sum([]byte(input))
-	hashString := hex.EncodeToString(hash[:])
+	channelID := u.channelFor(fileSize)
+	result.Size = fileSize
+
+	// The file replaced is kept until its replacement is stored under a
+	// temporary name. The pieces of a split file have names of their own.
+	uploadName := fileName
+	var info *FileInfo
+	if u.maxFileSize > 0 && fileSize > u.maxFileSize {
+		info, err = u.uploadSplit(filePath, fileName, mimeType, destDir, channelID, fileSize)
+		for offset := int64(0); offset < fileSize; offset += u.maxFileSize {
+			result.Parts += int(u.partCount(min(u.maxFileSize, fileSize-offset)))
+		}
+	} else {
+		if replace != nil {
+			uploadName = fileName + replacingSuffix
+		}
+		info, err = u.uploadRange(filePath, uploadName, mimeType, destDir, channelID, 0, fileSize)
+		result.Parts = int(u.partCount(fileSize))
+	}
+	if err != nil {
+		return err
+	}
+	if replace != nil {
+		if err := u.replaceFile(replace, info, uploadName, fileName, destDir); err != nil {
+			return err
+		}
+	}
+	result.RemoteID = info.Id
+	// The hashes of the pieces of a split file are in its manifest.
+	if u.hashing && !(u.maxFileSize > 0 && fileSize > u.maxFileSize) {
+		result.SHA256 = info.Hash
+	}
+	return nil
+}
+
+// partCount returns the number of parts a file of the given size is uploaded in.
+func (u *Uploader) partCount(fileSize int64) int64 {
+	return countParts(fileSize, u.partSizeFor(fileSize))
+}
+
+// partSizeFor returns the part size of a file of the given size. It is
+// PART_SIZE unless the file would have more than -max-parts parts, then
+// the smallest size in whole MiB that keeps it within them, up to
+// MAX_PART_SIZE.
+func (u *Uploader) partSizeFor(fileSize int64) int64 {
+	partSize := atomic.LoadInt64(&u.partSize)
+	if u.maxParts > 0 && countParts(fileSize, partSize) > u.maxParts {
+		partSize = countParts(countParts(fileSize, u.maxParts), minPartSize) * minPartSize
+	}
+	return min(partSize, atomic.LoadInt64(&u.maxPartSize))
+}
+
+// lowerPartSize lowers PART_SIZE and MAX_PART_SIZE to at most size, after
+// the server rejected parts larger than it.
+func (u *Uploader) lowerPartSize(size int64) {
+	for _, limit := range []*int64{&u.partSize, &u.maxPartSize} {
+		for {
+			current := atomic.LoadInt64(limit)
+			// Another file may have lowered it already.
+			if current <= size || atomic.CompareAndSwapInt64(limit, current, size) {
+				break
+			}
+		}
+	}
+}
+
+// countParts returns the number of parts of partSize a file of the given size
+// is split into.
+func countParts(fileSize, partSize int64) int64 {
+	numParts := fileSize / partSize
+	if fileSize%partSize != 0 {
+		numParts++
+	}
+	return numParts
+}
+
+// uploadRange uploads size bytes of filePath starting at offset as the remote
+// file fileName in destDir. In strict mode an upload the server assembled
+// with the wrong size is deleted and retried. When the server rejects parts
+// as too large the part size is halved for this and all following uploads.
+// An empty file has no parts and is only created.
+func (u *Uploader) uploadRange(filePath, fileName, mimeType, destDir string, channelID, offset, fileSize int64) (*FileInfo, error) {
+	if fileSize == 0 {
+		var digest string
+		if u.hashing {
+			digest, _ = newContentHasher().sum(nil, 0)
+			logHash(fileName, digest)
+		}
+		return u.createFile(&FilePayload{
+			Name:      fileName,
+			Type:      "file",
+			MimeType:  mimeType,
+			Path:      destDir,
+			ChannelID: channelID,
+			Category:  u.category,
+			Tags:      u.fileTags(filePath),
+			ModTime:   localModTime(filePath),
+			Hash:      digest,
+		})
+	}
+
+	for attempt := 1; ; {
+		partSize := u.partSizeFor(fileSize)
+		if numParts := countParts(fileSize, partSize); u.maxParts > 0 && numParts > u.maxParts {
+			Warning.Printf("%s needs %d parts of MAX_PART_SIZE %v, more than -max-parts %d", fileName, numParts, fs.SizeSuffix(partSize), u.maxParts)
+		}
+		info, err := u.uploadRangeOnce(filePath, fileName, mimeType, destDir, channelID, offset, fileSize, partSize)
+		if errors.Is(err, errPartTooLarge) && partSize/2 >= minPartSize {
+			u.lowerPartSize(partSize / 2)
+			Warning.Printf("%v, retrying with part size %v", err, fs.SizeSuffix(u.partSizeFor(fileSize)))
+			continue
+		}
+		if !errors.Is(err, errPartialFile) || attempt >= strictAttempts {
+			return info, err
+		}
+		Warning.Printf("%v, retrying (%d/%d)", err, attempt, strictAttempts)
+		attempt++
+	}
+}
+
+func (u *Uploader) uploadRangeOnce(filePath, fileName, mimeType, destDir string, channelID, offset, fileSize, partSize int64) (*FileInfo, error) {
+	hashString, err := u.sessionKey(filePath, fileName, destDir, offset, fileSize)
+	if err != nil {
+		return nil, err
+	}
 
 	uploadURL := fmt.Sprintf("/api/uploads/%s", hashString)
 
+	state, err := u.loadState(hashString, partSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every part reads through its own section of a single handle, which is
+	// closed once all parts are done.
+	var file *os.File
+	err = u.withIORetries(func() (err error) {
+		file, err = u.openFile(filePath, u.partSlots)
+		if err != nil {
+			return &localReadError{err}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	var wg sync.WaitGroup
 
-	numParts := fileSize / u.partSize
-	if fileSize%u.partSize != 0 {
-		numParts++
+	numParts := countParts(fileSize, partSize)
+
+	var hasher *contentHasher
+	if u.hashing {
+		hasher = newContentHasher()
 	}
+	var digest string
+	var hashErr error
 
-	uploadedParts := make(chan UploadPartOut, numParts)
-	concurrentWorkers := make(chan struct{}, u.numWorkers)
+	var parts []Part
+	uploadedParts := make(chan Part, numParts)
+	concurrentWorkers := u.partSlots
 
 	bar := progressbar.NewOptions64(fileSize,
 		progressbar.OptionSetWriter(os.Stderr),
@@ -204,22 +648,46 @@ func (u *Uploader) uploadFile(filePath string, destDir string) error {
 			BarEnd:        "]",
 		}),
 		progressbar.OptionFullWidth(),
-		progressbar.OptionSetRenderBlankState(true))
+		progressbar.OptionSetRenderBlankState(true),
+		// Bars of files uploaded at once would overwrite each other.
+		progressbar.OptionSetVisibility(u.fileWorkers <= 1 && !u.total.hasBar() && !u.quiet))
+
+	var sent int64
+	progress := func(n int64) {
+		bar.Add64(n)
+		atomic.AddInt64(&sent, n)
+		u.total.add(n)
+	}
 
-	go func() {
-		wg.Wait()
-		close(uploadedParts)
-		bar.Finish()
-		bar.Close()
-	}()
+	var tooLarge int32
+	var assembled atomic.Pointer[FileInfo]
+
+	// The first part error is returned as the reason the file failed.
+	var partErr error
+	var partErrOnce sync.Once
+	partFailed := func(partNo int64, err error) {
+		logWith(Error, logFields{File: fileName, Part: partNo}, "Error:", err)
+		partErrOnce.Do(func() { partErr = err })
+	}
+	stopProgress := u.trackProgress(fileName, fileSize, &sent)
 
-	for i := int64(0); i < numParts; i++ {
-		start := i * u.partSize
-		end := start + u.partSize
+	ctx, cancel := context.WithCancelCause(u.ctx)
+	defer cancel(nil)
+	stopWatching := u.watchSpeed(cancel, &sent)
+
+	for i := int64(0); i < numParts && ctx.Err() == nil; i++ {
+		start := i * partSize
+		end := start + partSize
 		if end > fileSize {
 			end = fileSize
 		}
 
+		if part, ok := state.uploaded(int(i + 1)); ok {
+			parts = append(parts, part)
+			progress(end - start)
+			continue
+		}
+
 		concurrentWorkers <- struct{}{}
 		wg.Add(1)
 
@@ -229,178 +697,604 @@ func (u *Uploader) uploadFile(filePath string, destDir string) error {
 				<-concurrentWorkers
 			}()
 
-			partFile, err := os.Open(filePath)
-			if err != nil {
-				Error.Println("Error:", err)
-				return
-			}
-			defer partFile.Close()
-
-			_, err = partFile.Seek(start, io.SeekStart)
-
-			if err != nil {
-				Error.Println("Error:", err)
-				return
-			}
-
 			name := fileName
 
 			if numParts > 1 {
-				name = fmt.Sprintf("%s.part.%03d", fileName, partNumber+1)
+				name = partName(u.partNaming, fileName, partNumber+1, numParts)
 			}
 
-			pr := &ProgressReader{partFile, func(r int64) {
-				bar.Add64(r)
-			}}
-
 			contentLength := end - start
-			reader := io.LimitReader(pr, contentLength)
 
-			opts := rest.Opts{
-				Method:        "POST",
-				Path:          uploadURL,
-				Body:          reader,
-				ContentLength: &contentLength,
-				Parameters: url.Values{
-					"fileName":   []string{name},
-					"partNo":     []string{strconv.FormatInt(partNumber+1, 10)},
-					"totalparts": []string{strconv.FormatInt(int64(numParts), 10)},
-					"channelId":  []string{strconv.FormatInt(int64(u.channelID), 10)},
-				},
+			// open reads the part from the start for each attempt, taking
+			// the bytes sent by a failed attempt back off the progress.
+			var read int64
+			open := func() (io.Reader, error) {
+				progress(-read)
+				read = 0
+
+				section := io.NewSectionReader(file, offset+start, contentLength)
+				pr := &ProgressReader{Ctx: ctx, Reader: localReader{hasher.tee(section, start)}, Reporter: func(r int64) {
+					read += r
+					progress(r)
+				}}
+				if u.bandwidth != nil {
+					pr.Limiter = u.bandwidth.limiter
+				}
+				return pr, nil
 			}
 
-			var part UploadPartOut
-			resp, err := u.http.CallJSON(context.TODO(), &opts, nil, &part)
+			var part *UploadPartOut
+			err := u.withIORetries(func() (err error) {
+				part, err = u.uploadPart(ctx, uploadURL, name, channelID, partNumber+1, numParts, open, contentLength)
+				return err
+			})
 
+			if errors.Is(err, errPartTooLarge) {
+				atomic.StoreInt32(&tooLarge, 1)
+				return
+			}
 			if err != nil {
-				Error.Println("Error:", err)
+				partFailed(partNumber+1, err)
 				return
 			}
 
-			if resp.StatusCode == 200 {
-				uploadedParts <- part
+			if part.File != nil && part.File.Id != "" {
+				assembled.Store(part.File)
+			}
+
+			uploaded := Part{ID: int64(part.PartId), PartNo: part.PartNo}
+			if err := state.add(uploaded); err != nil {
+				Warning.Println("saving upload state failed:", err)
 			}
+			uploadedParts <- uploaded
 		}(i, start, end)
 	}
 
-	var parts []Part
-	for uploadPart := range uploadedParts {
-		parts = append(parts, Part{ID: int64(uploadPart.PartId), PartNo: uploadPart.PartNo})
+	// Parts may all have finished while the loop above waited for a worker
+	// slot, so the channel is only closed once every part has been started.
+	go func() {
+		wg.Wait()
+		// The parts uploaded before a resume, or read ahead of the hash,
+		// are read for it while the file is still open.
+		if hasher != nil && ctx.Err() == nil && partErr == nil && atomic.LoadInt32(&tooLarge) == 0 {
+			digest, hashErr = hasher.sum(io.NewSectionReader(file, offset, fileSize), fileSize)
+		}
+		file.Close()
+		close(uploadedParts)
+		stopWatching()
+		stopProgress()
+		bar.Finish()
+		bar.Close()
+	}()
+
+	for part := range uploadedParts {
+		parts = append(parts, part)
 	}
 
 	if len(parts) != int(numParts) {
-		return fmt.Errorf("upload failed: %s", fileName)
+		if atomic.LoadInt32(&tooLarge) != 0 {
+			if err := u.deleteUploadSession(uploadURL); err != nil {
+				Error.Println("Error:", err)
+			}
+			if err := state.remove(); err != nil {
+				Error.Println("Error:", err)
+			}
+			return nil, fmt.Errorf("%w: %s parts of %v", errPartTooLarge, fileName, fs.SizeSuffix(partSize))
+		}
+		if cause := context.Cause(ctx); cause != nil {
+			if u.ctx.Err() != nil {
+				u.discardInterrupted(uploadURL, state)
+			}
+			return nil, fmt.Errorf("%s: %w", fileName, cause)
+		}
+		return nil, fmt.Errorf("part of %s failed: %w", fileName, partErr)
+	}
+
+	if hashErr != nil {
+		return nil, fmt.Errorf("hashing %s: %w", fileName, hashErr)
+	}
+	if digest != "" {
+		logHash(fileName, digest)
 	}
 
 	sort.Slice(parts, func(i, j int) bool {
 		return parts[i].PartNo < parts[j].PartNo
 	})
 
-	filePayload := FilePayload{
-		Name:      fileName,
-		Type:      "file",
-		Parts:     parts,
-		MimeType:  mimeType,
-		Path:      destDir,
-		Size:      fileSize,
-		ChannelID: u.channelID,
-	}
-
-	json.Marshal(filePayload)
+	info := assembled.Load()
+	if info == nil {
+		filePayload := FilePayload{
+			Name:      fileName,
+			Type:      "file",
+			Parts:     parts,
+			MimeType:  mimeType,
+			Path:      destDir,
+			Size:      fileSize,
+			ChannelID: channelID,
+			Category:  u.category,
+			Tags:      u.fileTags(filePath),
+			ModTime:   localModTime(filePath),
+			Hash:      digest,
+		}
 
-	if err != nil {
-		return err
+		info, err = u.createFile(&filePayload)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		Info.Println("server assembled", fileName, "from its parts")
 	}
 
-	opts := rest.Opts{
-		Method: "POST",
-		Path:   "/api/files",
+	if err := u.deleteUploadSession(uploadURL); err != nil {
+		return nil, err
 	}
 
-	err = u.pacer.Call(func() (bool, error) {
-		resp, err := u.http.CallJSON(u.ctx, &opts, &filePayload, nil)
-		return shouldRetry(u.ctx, resp, err)
-	})
-
-	if err != nil {
-		return err
+	if err := state.remove(); err != nil {
+		return nil, err
 	}
 
-	err = u.pacer.Call(func() (bool, error) {
-		resp, err := u.http.CallJSON(u.ctx, &rest.Opts{Method: "DELETE", Path: uploadURL}, nil, nil)
-		return shouldRetry(u.ctx, resp, err)
-	})
+	if u.strict {
+		if err := u.checkAssembled(info, destDir, fileName, fileSize); err != nil {
+			return nil, err
+		}
+	} else if u.verify {
+		if err := u.verifyCreated(info, destDir, fileName, fileSize); err != nil {
+			return nil, err
+		}
+	}
+	if info.Hash == "" {
+		info.Hash = digest
+	}
+	return info, nil
+}
 
+// findCreated re-reads the metadata of a newly created file from destDir.
+func (u *Uploader) findCreated(created *FileInfo, destDir, fileName string) (*FileInfo, error) {
+	files, err := u.list(destDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	for i, item := range files {
+		if (created.Id != "" && item.Id != created.Id) || (created.Id == "" && item.Name != fileName) {
+			continue
+		}
+		return &files[i], nil
+	}
+	return nil, fmt.Errorf("created file %s not found in %s", fileName, destDir)
 }
 
-func (u *Uploader) createRemoteDir(path string) error {
-	opts := rest.Opts{
-		Method: "POST",
-		Path:   "/api/files/makedir",
+// checkAssembled re-reads the metadata of a newly created file and deletes it
+// if the server assembled it with a size other than the local one.
+func (u *Uploader) checkAssembled(created *FileInfo, destDir, fileName string, fileSize int64) error {
+	item, err := u.findCreated(created, destDir, fileName)
+	if err != nil {
+		return err
 	}
-
-	if len(path) == 0 || path[0] != '/' {
-		path = "/" + path
+	if item.Size == fileSize {
+		return nil
 	}
-
-	mkdir := CreateDirRequest{
-		Path: path,
+	if err := u.deleteFile(item.Id); err != nil {
+		return err
 	}
+	return fmt.Errorf("%w: %s is %d bytes, expected %d", errPartialFile, fileName, item.Size, fileSize)
+}
 
-	err := u.pacer.Call(func() (bool, error) {
-		resp, err := u.http.CallJSON(u.ctx, &opts, &mkdir, nil)
-		return shouldRetry(u.ctx, resp, err)
-	})
-
+// verifyCreated checks that a newly created file is listed in destDir with
+// its name and the local size.
+func (u *Uploader) verifyCreated(created *FileInfo, destDir, fileName string, fileSize int64) error {
+	item, err := u.findCreated(created, destDir, fileName)
 	if err != nil {
 		return err
 	}
+	if item.Name != fileName || item.Size != fileSize {
+		return fmt.Errorf("verify failed: remote file %s is %d bytes, expected %s with %d bytes", item.Name, item.Size, fileName, fileSize)
+	}
 	return nil
 }
 
-func (u *Uploader) readMetaDataForPath(path string, options *MetadataRequestOptions) (*ReadMetadataResponse, error) {
+// runRetryDelay is the wait before the first -run-retries retry, doubled for
+// each following one up to maxRunRetryDelay.
+const (
+	runRetryDelay    = 30 * time.Second
+	maxRunRetryDelay = 10 * time.Minute
+)
 
-	opts := rest.Opts{
-		Method: "GET",
-		Path:   "/api/files",
-		Parameters: url.Values{
-			"path":          []string{path},
-			"perPage":       []string{strconv.FormatUint(options.PerPage, 10)},
-			"sort":          []string{"name"},
-			"order":         []string{"asc"},
-			"op":            []string{"list"},
-			"nextPageToken": []string{options.NextPageToken},
-		},
-	}
-	var err error
-	var info ReadMetadataResponse
-	var resp *http.Response
+// fileLimitRetries is how many times opening a file is retried when the
+// process has run out of file descriptors.
+const fileLimitRetries = 5
 
-	err = u.pacer.Call(func() (bool, error) {
-		resp, err = u.http.CallJSON(u.ctx, &opts, nil, &info)
-		return shouldRetry(u.ctx, resp, err)
-	})
+// isFileLimitError reports whether err was caused by running out of file
+// descriptors.
+func isFileLimitError(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
 
-	if err != nil && resp.StatusCode == 404 {
-		return nil, fs.ErrorDirNotFound
-	}
+// openFile opens filePath for reading its parts. When the process is out of
+// file descriptors it permanently takes one of the part worker slots,
+// lowering the number of parts read at once, and tries again. The last slot
+// is never taken, so parts can always make progress.
+func (u *Uploader) openFile(filePath string, workers chan struct{}) (*os.File, error) {
+	for attempt := 1; ; attempt++ {
+		file, err := os.Open(filePath)
+		if err == nil || !isFileLimitError(err) || attempt > fileLimitRetries {
+			return file, err
+		}
 
-	if err != nil {
-		return nil, err
-	}
+		u.fileLimitHint.Do(func() {
+			Warning.Println("too many open files, reducing concurrency. Raise the limit with `ulimit -n` to avoid this")
+		})
 
-	return &info, nil
+		if atomic.AddInt32(&u.heldSlots, 1) < int32(cap(workers)) {
+			select {
+			case workers <- struct{}{}:
+			default:
+				atomic.AddInt32(&u.heldSlots, -1)
+			}
+		} else {
+			atomic.AddInt32(&u.heldSlots, -1)
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
 }
 
-func (u *Uploader) list(path string) (files []FileInfo, err error) {
+// uploadPart posts one part of the upload session at uploadURL, retrying
+// with the pacer on transient errors. open is called for each attempt to
+// get the part's content from the start.
+func (u *Uploader) uploadPart(ctx context.Context, uploadURL string, name string, channelID, partNo, totalParts int64, open func() (io.Reader, error), size int64) (*UploadPartOut, error) {
+	var part UploadPartOut
+	err := u.pacer.Call(func() (bool, error) {
+		reader, err := open()
+		if err != nil {
+			return false, err
+		}
 
-	var limit uint64 = 500
-	var nextPageToken string = ""
+		opts := rest.Opts{
+			Method:        "POST",
+			Path:          uploadURL,
+			Body:          reader,
+			ContentLength: &size,
+			// Replays the part when the server redirects it elsewhere.
+			GetBody: func() (io.ReadCloser, error) {
+				reader, err := open()
+				if err != nil {
+					return nil, err
+				}
+				return io.NopCloser(reader), nil
+			},
+			Parameters: url.Values{
+				"fileName":   []string{name},
+				"partNo":     []string{strconv.FormatInt(partNo, 10)},
+				"totalparts": []string{strconv.FormatInt(totalParts, 10)},
+				"channelId":  []string{strconv.FormatInt(channelID, 10)},
+			},
+		}
+
+		resp, err := u.callJSONTimeout(ctx, u.partTimeout, &opts, nil, &part)
+		var readErr *localReadError
+		if errors.As(err, &readErr) {
+			return false, err
+		}
+		if resp != nil && resp.StatusCode == http.StatusRequestEntityTooLarge {
+			return false, fmt.Errorf("%w: part %d: %v", errPartTooLarge, partNo, err)
+		}
+		// Servers that don't report the stored size send 0.
+		if err == nil && part.Size != 0 && part.Size != size {
+			return true, fmt.Errorf("part %d of %s: server stored %d bytes, sent %d", partNo, name, part.Size, size)
+		}
+		return u.shouldRetry(ctx, resp, err)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if u.verifyChannel && channelID != 0 && part.ChannelID != channelID {
+		return nil, fmt.Errorf("part %d of %s was stored in channel %d instead of %d", partNo, name, part.ChannelID, channelID)
+	}
+	logWith(Debug, logFields{File: name, Part: partNo, Bytes: size}, fmt.Sprintf("uploaded part %d of %d: %s, %d bytes", partNo, totalParts, name, size))
+	return &part, nil
+}
+
+// createFile creates the remote file record assembling the uploaded parts.
+func (u *Uploader) createFile(payload *FilePayload) (*FileInfo, error) {
+	opts := rest.Opts{
+		Method: "POST",
+		Path:   "/api/files",
+	}
+
+	var info FileInfo
+	var resp *http.Response
+	err := u.pacer.Call(func() (bool, error) {
+		var err error
+		resp, err = u.callJSON(u.ctx, &opts, payload, &info)
+		if errors.Is(err, io.EOF) {
+			// The file was created but the server sent no details back.
+			return false, nil
+		}
+		return u.shouldRetry(u.ctx, resp, err)
+	})
+	// Even a failed call may have created the file.
+	u.dirCache.invalidate(remotePath(payload.Path))
+
+	if err != nil && resp != nil && resp.StatusCode == http.StatusConflict && !payload.exclusive {
+		return u.resolveConflict(payload, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// resolveConflict handles a file creation rejected with 409 Conflict
+// because a file of the same name appeared in the meantime, e.g. created
+// by a retried request or another uploader. A file of the same size is
+// taken as this upload, anything else is an error.
+func (u *Uploader) resolveConflict(payload *FilePayload, err error) (*FileInfo, error) {
+	files, listErr := u.list(payload.Path)
+	if listErr != nil {
+		return nil, fmt.Errorf("%w, listing %s: %v", err, payload.Path, listErr)
+	}
+	existing := findFile(payload.Name, files)
+	if existing == nil {
+		return nil, err
+	}
+	if existing.Size != payload.Size {
+		return nil, fmt.Errorf("%s already exists in %s with size %d instead of %d: %w", payload.Name, payload.Path, existing.Size, payload.Size, err)
+	}
+	Info.Println("file created concurrently, keeping it:", payload.Name)
+	return existing, nil
+}
+
+// deleteUploadSession removes the parts stored for an upload session, unless
+// sessions are being kept for inspection.
+func (u *Uploader) deleteUploadSession(uploadURL string) error {
+	if u.keepSession {
+		Info.Println("keeping upload session:", uploadURL)
+		return nil
+	}
+	ctx, cancel := u.cleanupCtx()
+	defer cancel()
+	return u.pacer.Call(func() (bool, error) {
+		resp, err := u.callJSON(ctx, &rest.Opts{Method: "DELETE", Path: uploadURL}, nil, nil)
+		return u.shouldRetry(ctx, resp, err)
+	})
+}
+
+// updateFile changes the name or modification time of the remote file with
+// the given id. Like deleteFile it is finished after an interrupt.
+func (u *Uploader) updateFile(id string, update *UpdateFileRequest) error {
+	opts := rest.Opts{
+		Method: "PATCH",
+		Path:   "/api/files/" + id,
+	}
+
+	defer u.dirCache.invalidateAll()
+
+	ctx, cancel := u.cleanupCtx()
+	defer cancel()
+	return u.pacer.Call(func() (bool, error) {
+		resp, err := u.callJSON(ctx, &opts, update, nil)
+		return u.shouldRetry(ctx, resp, err)
+	})
+}
+
+// deleteFile removes the remote file with the given id.
+func (u *Uploader) deleteFile(id string) error {
+	opts := rest.Opts{
+		Method: "DELETE",
+		Path:   "/api/files/" + id,
+	}
+
+	// The directory of the file isn't known here.
+	defer u.dirCache.invalidateAll()
+
+	ctx, cancel := u.cleanupCtx()
+	defer cancel()
+	return u.pacer.Call(func() (bool, error) {
+		resp, err := u.callJSON(ctx, &opts, nil, nil)
+		return u.shouldRetry(ctx, resp, err)
+	})
+}
+
+// uploadBytes uploads data as a single part file named name in destDir.
+func (u *Uploader) uploadBytes(name, mimeType, destDir string, channelID int64, data []byte) (*FileInfo, error) {
+	return u.uploadPayload(&FilePayload{
+		Name:      name,
+		MimeType:  mimeType,
+		Path:      destDir,
+		ChannelID: channelID,
+	}, data)
+}
+
+// uploadPayload uploads data as a single part and creates the file
+// described by payload from it.
+func (u *Uploader) uploadPayload(payload *FilePayload, data []byte) (*FileInfo, error) {
+	name, destDir, channelID := payload.Name, payload.Path, payload.ChannelID
+	size := int64(len(data))
+
+	hash := md5.Sum([]byte(fmt.Sprintf("%s:%s:%d", name, destDir, size)))
+	uploadURL := fmt.Sprintf("/api/uploads/%s", hex.EncodeToString(hash[:]))
+
+	part, err := u.uploadPart(u.ctx, uploadURL, name, channelID, 1, 1, func() (io.Reader, error) {
+		return bytes.NewReader(data), nil
+	}, size)
+	if err != nil {
+		return nil, err
+	}
+
+	payload.Type = "file"
+	payload.Parts = []Part{{ID: int64(part.PartId), PartNo: part.PartNo}}
+	payload.Size = size
+	info, err := u.createFile(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, u.deleteUploadSession(uploadURL)
+}
+
+// existingDir returns dir, or its closest parent that exists if it doesn't.
+func (u *Uploader) existingDir(dir string) (string, error) {
+	dir = remotePath(dir)
+	for dir != "/" {
+		// Not list, which takes missing directories as empty in a dry run.
+		_, err := u.readMetaDataForPath(dir, &MetadataRequestOptions{PerPage: 1})
+		if !errors.Is(err, fs.ErrorDirNotFound) {
+			return dir, err
+		}
+		dir = path.Dir(dir)
+	}
+	return dir, nil
+}
+
+// probeWrite confirms that the session can write to destDir by uploading a
+// small probe file there and deleting it again.
+func (u *Uploader) probeWrite(destDir string) error {
+	name := fmt.Sprintf(".uploader-probe-%d", time.Now().UnixNano())
+
+	info, err := u.uploadBytes(name, "text/plain", destDir, u.channelID, []byte("teldrive-upload write probe\n"))
+	if err != nil {
+		return err
+	}
+
+	if info.Id == "" {
+		return fmt.Errorf("server did not return an id for probe file %s", name)
+	}
+	return u.deleteFile(info.Id)
+}
+
+// checkRemoteDir fails if dir exists remotely as something other than a
+// directory. A missing dir is fine, it is created before uploading.
+func (u *Uploader) checkRemoteDir(dir string) error {
+	dir = remotePath(dir)
+	if dir == "/" {
+		return nil
+	}
+
+	files, err := u.list(path.Dir(dir))
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if item := findFile(path.Base(dir), files); item != nil && item.Type != "folder" && item.Type != "dir" {
+		return fmt.Errorf("destination %s is a %s, not a directory", dir, item.Type)
+	}
+	return nil
+}
+
+func (u *Uploader) createRemoteDir(dir string) error {
+	if u.dryRun {
+		Info.Println("would create directory:", remotePath(dir))
+		return nil
+	}
+
+	opts := rest.Opts{
+		Method: "POST",
+		Path:   "/api/files/makedir",
+	}
+
+	mkdir := CreateDirRequest{
+		Path: remotePath(dir),
+	}
+
+	var resp *http.Response
+	err := u.pacer.Call(func() (bool, error) {
+		var err error
+		resp, err = u.callJSON(u.ctx, &opts, &mkdir, nil)
+		return u.shouldRetry(u.ctx, resp, err)
+	})
+	u.dirCache.invalidate(path.Dir(mkdir.Path))
+
+	if err != nil && dirExists(resp, err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// dirExists reports whether a failed makedir call failed because the
+// directory already exists, by its status code or error message.
+func dirExists(resp *http.Response, err error) bool {
+	if resp == nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusConflict || strings.Contains(strings.ToLower(err.Error()), "already exists")
+}
+
+// createRemoteDirAll creates dir and every missing ancestor of it, one level
+// at a time, since servers don't all create parents. An ancestor that fails
+// to be created but is listed as a directory already exists and is kept.
+func (u *Uploader) createRemoteDirAll(dir string) error {
+	dir = remotePath(dir)
+	if dir == "/" {
+		return nil
+	}
+
+	current := "/"
+	for _, elem := range strings.Split(strings.TrimPrefix(dir, "/"), "/") {
+		current = path.Join(current, elem)
+		err := u.createRemoteDir(current)
+		if err == nil {
+			continue
+		}
+		files, listErr := u.list(path.Dir(current))
+		if item := findFile(elem, files); listErr != nil || item == nil || !isFolder(item) {
+			return fmt.Errorf("creating %s: %w", current, err)
+		}
+	}
+	return nil
+}
+
+func (u *Uploader) readMetaDataForPath(path string, options *MetadataRequestOptions) (*ReadMetadataResponse, error) {
+
+	opts := rest.Opts{
+		Method: "GET",
+		Path:   "/api/files",
+		Parameters: url.Values{
+			"path":          []string{path},
+			"perPage":       []string{strconv.FormatUint(options.PerPage, 10)},
+			"sort":          []string{"name"},
+			"order":         []string{"asc"},
+			"op":            []string{"list"},
+			"nextPageToken": []string{options.NextPageToken},
+		},
+	}
+	var err error
+	var info ReadMetadataResponse
+	var resp *http.Response
+
+	err = u.pacer.Call(func() (bool, error) {
+		resp, err = u.callJSON(u.ctx, &opts, nil, &info)
+		return u.shouldRetry(u.ctx, resp, err)
+	})
+
+	if err != nil && resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, fs.ErrorDirNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// list returns every entry of the remote directory path. The path is
+// cleaned first, so /a/, /a, a and ./a all list the same directory.
+// Listings are served from u.dirCache once read.
+func (u *Uploader) list(path string) (files []FileInfo, err error) {
+	path = remotePath(path)
+	if cached, ok := u.dirCache.get(path); ok {
+		return cached, nil
+	}
+
+	var limit uint64 = 500
+	var nextPageToken string = ""
 	for {
 		opts := &MetadataRequestOptions{
 			PerPage:       limit,
@@ -408,6 +1302,10 @@ func (u *Uploader) list(path string) (files []FileInfo, err error) {
 		}
 
 		info, err := u.readMetaDataForPath(path, opts)
+		if u.dryRun && errors.Is(err, fs.ErrorDirNotFound) {
+			// The directory would have been created empty.
+			return nil, nil
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -419,117 +1317,923 @@ func (u *Uploader) list(path string) (files []FileInfo, err error) {
 			break
 		}
 	}
+	u.dirCache.put(path, files)
+	Debug.Printf("listed %s: %d entries", path, len(files))
 	return files, nil
 }
 
-func (u *Uploader) checkFileExists(name string, files []FileInfo) bool {
-	for _, item := range files {
-		if item.Name == name {
-			return true
-		}
+func (u *Uploader) checkFileExists(name string, files remoteFiles) bool {
+	return files[name] != nil
+}
+
+// relativePath returns the slash separated path of fullPath relative to the
+// source root, which is how files are addressed in the walk order.
+func (u *Uploader) relativePath(fullPath string) string {
+	rel, err := filepath.Rel(u.sourceRoot, fullPath)
+	if err != nil {
+		return filepath.ToSlash(fullPath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// skipBeforeStart reports whether the entry at relPath comes before the
+// -start-after position in the walk order, or is inside it, and should not
+// be uploaded. Paths are compared rather than waiting for the position to
+// be found, so a position that was deleted or renamed since still starts
+// the upload at the entry after it.
+func (u *Uploader) skipBeforeStart(relPath string, isDir bool) bool {
+	if u.startAfter == "" || u.started {
+		return false
 	}
+	if isDir && strings.HasPrefix(u.startAfter, relPath+"/") {
+		return false
+	}
+	if walkOrder(relPath, u.startAfter) <= 0 || strings.HasPrefix(relPath, u.startAfter+"/") {
+		return true
+	}
+	u.started = true
 	return false
 }
 
-func (u *Uploader) uploadFilesInDirectory(sourcePath string, destDir string) error {
+// walkOrder compares the relative paths a and b by the order in which the
+// walk visits them: name by name, a directory before its entries. The
+// result is negative if a comes first, 0 if they are equal and positive if
+// b comes first.
+func walkOrder(a, b string) int {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// uploadFilesInDirectory walks sourcePath depth first and returns the results
+// of the files it uploaded. Entries of each directory are visited in lexical
+// order of their names (as returned by os.ReadDir), so the walk order is
+// stable between runs.
+func (u *Uploader) uploadFilesInDirectory(sourcePath string, destDir string) ([]UploadResult, error) {
+	rules, err := loadIgnoreFile(sourcePath)
+	if err != nil {
+		Error.Println("upload failed:", err)
+		return nil, err
+	}
+	u.ignore = rules
+	u.flatNames = map[string]bool{}
+	u.walkedDirs = map[string]bool{}
+	if _, err := u.enterDir(sourcePath); err != nil {
+		Error.Println("upload failed:", err)
+		return nil, err
+	}
+
+	pool := newFilePool(u.fileWorkers)
+	walks := newWalkGroup(u.walkers)
+	if walks != nil {
+		pool.queueFiles(u.ctx, walkQueueSize)
+	}
+	err = u.walkDirectory(sourcePath, destDir, 0, pool, walks)
+	err = errors.Join(err, walks.wait())
+	return pool.wait(), err
+}
+
+// walkDirectory uploads the files of sourcePath, depth levels below the
+// source root, into destDir through pool and recurses into its
+// subdirectories as far as -max-depth allows, through walks with -walkers.
+// Files and directories that can't be walked are logged and skipped, and
+// their errors returned joined together. The results of the uploads are
+// collected by pool.
+func (u *Uploader) walkDirectory(sourcePath string, destDir string, depth int, pool *filePool, walks *walkGroup) error {
 	entries, err := os.ReadDir(sourcePath)
 	if err != nil {
+		Error.Println("upload failed:", err)
 		return err
 	}
 
-	destDir = strings.ReplaceAll(destDir, "\\", "/")
+	destDir = remotePath(destDir)
 
 	files, err := u.list(destDir)
 
 	if err != nil {
+		err = fmt.Errorf("listing %s: %w", destDir, err)
+		Error.Println("upload failed:", err)
 		return err
 	}
 
+	index := indexFiles(files)
+	listings := map[string]remoteFiles{destDir: index}
+
+	var errs []error
+	failed := func(path string, err error) {
+		Error.Println("upload failed:", path, err)
+		errs = append(errs, fmt.Errorf("%s: %w", path, err))
+	}
+
 	for _, entry := range entries {
+		if err := u.ctx.Err(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+
 		fullPath := filepath.Join(sourcePath, entry.Name())
 
+		entry, ok, err := u.resolveSymlink(fullPath, entry)
+		if err != nil {
+			failed(fullPath, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if u.skipBeforeStart(u.relativePath(fullPath), entry.IsDir()) {
+			continue
+		}
+
+		if u.filter.excluded(u.relativePath(fullPath), entry.IsDir()) {
+			continue
+		}
+
+		if u.ignore.ignored(u.relativePath(fullPath), entry.IsDir()) {
+			continue
+		}
+
 		if entry.IsDir() {
-			subDir := filepath.Join(destDir, entry.Name())
-			subDir = strings.ReplaceAll(subDir, "\\", "/")
-			err := u.createRemoteDir(subDir)
+			if u.maxDepth >= 0 && depth >= u.maxDepth {
+				continue
+			}
+			if walked, err := u.enterDir(fullPath); err != nil {
+				failed(fullPath, err)
+				continue
+			} else if walked {
+				Warning.Println("skipping directory walked before, symlink loop?", fullPath)
+				continue
+			}
+			subDir := destDir
+			if !u.flatten {
+				dirName := u.remoteName(entry.Name())
+				logRenamed(entry.Name(), dirName)
+				subDir = remotePath(destDir, dirName)
+				if err := u.createRemoteDir(subDir); err != nil {
+					failed(fullPath, fmt.Errorf("creating %s: %w", subDir, err))
+					continue
+				}
+			}
+			// Errors below are logged where they happen.
+			err := walks.walk(func() error {
+				return u.walkDirectory(fullPath, subDir, depth+1, pool, walks)
+			})
 			if err != nil {
-				Error.Fatalln(err)
+				errs = append(errs, err)
 			}
-			err = u.uploadFilesInDirectory(fullPath, subDir)
-			Error.Println(err)
 		} else {
+			if u.skipLocked || u.stableWait > 0 {
+				skip, err := u.skipLive(fullPath)
+				if err != nil {
+					failed(fullPath, err)
+					continue
+				}
+				if skip {
+					continue
+				}
+			}
 
-			exists := u.checkFileExists(entry.Name(), files)
-			if !exists {
-				err := u.uploadFile(fullPath, destDir)
+			if u.selectCommand != "" {
+				selected, err := u.selectScript(fullPath)
 				if err != nil {
-					Error.Println("upload failed:", entry.Name(), err)
+					failed(fullPath, err)
+					continue
+				}
+				if !selected {
+					continue
 				}
+			}
+
+			fileDest, fileList := destDir, index
+			if len(u.routes) > 0 {
+				fileDest, fileList, err = u.routeFile(fullPath, destDir, listings)
+				if err != nil {
+					failed(fullPath, err)
+					continue
+				}
+			}
+
+			name := entry.Name()
+			if u.flatten {
+				name = u.flatName(u.relativePath(fullPath))
+			}
+
+			action, replace, err := u.decide(fullPath, name, entry, fileList)
+			if err != nil {
+				failed(fullPath, err)
+				continue
+			}
+
+			if action == actionSkip {
+				Info.Println("file exists:", name)
+				if info, err := entry.Info(); err == nil {
+					u.total.fileDone(info.Size())
+				}
+			} else if u.priority == "newest" {
+				info, err := entry.Info()
+				if err != nil {
+					failed(fullPath, err)
+					continue
+				}
+				u.walkMu.Lock()
+				u.queue = append(u.queue, queuedFile{path: fullPath, name: name, destDir: fileDest, modTime: info.ModTime(), replace: replace})
+				u.walkMu.Unlock()
 			} else {
-				Info.Println("file exists:", entry.Name())
+				u.uploadInPool(pool, fullPath, name, fileDest, replace)
 			}
 		}
 	}
-	return nil
+	return errors.Join(errs...)
+}
+
+// sourceDirName returns the name of the source directory as used by
+// -include-source-dir. Relative paths such as "." or ".." are resolved first
+// so that they give the real directory name.
+func sourceDirName(sourcePath string) (string, error) {
+	abs, err := filepath.Abs(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(abs)
+	if name == string(filepath.Separator) || name == "." || strings.HasSuffix(name, ":") {
+		return "", fmt.Errorf("can't include the name of source directory %s", sourcePath)
+	}
+	return name, nil
+}
+
+// holdsSingleFile reports whether dir contains exactly one entry, a file.
+func holdsSingleFile(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	return err == nil && len(entries) == 1 && !entries[0].IsDir()
+}
+
+// uploadQueued uploads the files deferred by the walk, most recently modified
+// first.
+func (u *Uploader) uploadQueued() []UploadResult {
+	sort.SliceStable(u.queue, func(i, j int) bool {
+		return u.queue[i].modTime.After(u.queue[j].modTime)
+	})
+	pool := newFilePool(u.fileWorkers)
+	for _, file := range u.queue {
+		if u.ctx.Err() != nil {
+			break
+		}
+		u.uploadInPool(pool, file.path, file.name, file.destDir, file.replace)
+	}
+	u.queue = nil
+	return pool.wait()
 }
 
 func main() {
-	sourcePath := flag.String("path", "", "File or directory path to upload")
+	op := flag.String("op", "upload", "Operation: upload, init to write an -env-file template, config-check to print the resolved config, benchmark to compare WORKERS and PART_SIZE settings, list to print the contents of -dest or delete to delete -dest")
+	recursive := flag.Bool("recursive", false, "Delete directories and their contents with -op delete")
+	benchmarkSize := fs.SizeSuffix(128 * fs.Mebi)
+	flag.Var(&benchmarkSize, "benchmark-size", "Size of the file uploaded by -op benchmark")
+	sourcePath := flag.String("path", "", "File or directory path to upload, - to read a file from standard input")
+	followSymlinks := flag.Bool("follow-symlinks", false, "Upload the targets of symbolic links in a directory instead of skipping them")
+	flatten := flag.Bool("flatten", false, "Upload the files of all subdirectories directly into -dest without recreating the tree")
+	maxDepth := flag.Int("max-depth", -1, "Levels of subdirectories uploaded below -path, 0 for only its files, -1 for all")
+	walkers := flag.Int("walkers", 1, "Number of directories read at once while walking -path, files are uploaded while the walk goes on")
+	noSanitize := flag.Bool("no-sanitize", false, "Send file and directory names as they are, without replacing characters the server may reject")
+	sanitizeChar := flag.String("sanitize-char", "_", "Character that replaces control characters and \\:*?\"<>| in remote names")
+	remoteName := flag.String("name", "", "Remote name of a single file or of the file read from standard input with -path -")
 	destDir := flag.String("dest", "", "Remote directory for uploaded files")
+	dryRun := flag.Bool("dry-run", false, "Print the files that would be uploaded and the directories that would be created without changing anything")
+	probe := flag.Bool("probe", false, "Check write permission on the destination with a probe file before uploading")
+	startAfter := flag.String("start-after", "", "Skip files in the walk order up to and including this relative path")
+	include := flag.String("include", "", "Comma separated globs of the files to upload from a directory, e.g. *.mp4,*.mkv")
+	exclude := flag.String("exclude", "", "Comma separated globs of files and directories to leave out, e.g. *.nfo,**/tmp/**")
+	priority := flag.String("priority", "", "Upload order for directories: empty for walk order or newest")
+	channelBalance := flag.Bool("channel-balance", false, "Spread files across CHANNEL_IDS, picking the channel with the least data")
+	ioRetries := flag.Int("io-retries", 3, "Times a part is retried after an error reading the local file")
+	verify := flag.Bool("verify", false, "Check that each created file is listed remotely with the local name and size")
+	hashFiles := flag.Bool("hash", false, "Compute the SHA-256 hash of each file while uploading it, log it and send it with the file")
+	strict := flag.Bool("strict", false, "Check the size of each created file and re-upload it on mismatch")
+	update := flag.Bool("update", false, "Upload files again whose remote size differs, same as -compare-method size")
+	checksum := flag.Bool("checksum", false, "Upload files again whose content changed, same as -compare-method checksum")
+	overwrite := flag.Bool("overwrite", false, "Replace every file that exists remotely, same as -compare-method overwrite")
+	newer := flag.Bool("newer", false, "Upload files again that were modified after their remote copy, same as -compare-method mtime")
+	compareMethod := flag.String("compare-method", "name", "How existing remote files are compared: name, size, mtime, checksum or overwrite")
+	lock := flag.Bool("lock", false, "Hold a lock file in the destination while uploading and skip the run if another upload holds it")
+	lockStale := flag.Duration("lock-stale", time.Hour, "Age after which an existing lock file is considered abandoned")
+	outputFormat := flag.String("output-format", "", "Print a summary of the uploaded files, or the listing of -op list, as table, json or csv")
+	jsonOutput := flag.Bool("json", false, "Print the summary or listing as JSON, same as -output-format json")
+	verifyChannel := flag.Bool("verify-channel", false, "Fail parts the server stored in a channel other than the requested one")
+	rampUpDuration := flag.Duration("ramp-up-duration", 0, "Start with one part worker and reach WORKERS over this duration")
+	stateDir := flag.String("state-dir", defaultStateDir(), "Directory where the parts of unfinished uploads are recorded for resuming, empty to disable")
+	category := flag.String("category", "", "Category of the uploaded files: "+strings.Join(categories, ", "))
+	tags := flag.String("tags", "", "Comma separated tags added to the uploaded files")
+	extTagsFlag := flag.String("ext-tags", "", "Comma separated ext=tag pairs adding tags to files by extension, e.g. mkv=movie,jpg=photo")
+	selectCommand := flag.String("select-script", "", "Command run with the path, size and modification time of each file, exit code 0 uploads the file and 1 skips it")
+	selectTimeout := flag.Duration("select-timeout", 10*time.Second, "Time limit for each -select-script run")
+	maxClockSkew := flag.Duration("max-clock-skew", 5*time.Minute, "Warn when the local clock differs from the server clock by more than this, 0 to disable")
+	checkAuth := flag.Bool("check-auth", false, "Check the session token and its expiry before uploading")
+	logFile := flag.String("log-file", "", "Also write logs to this file")
+	logFormat := flag.String("log-format", "text", "Log as colored text or as json, one object per line")
+	maxDuration := flag.Duration("max-duration", 0, "Stop the upload after this long, cancelling the parts in flight, as with Ctrl-C")
+	logLevel := flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
+	quiet := flag.Bool("quiet", false, "Log only errors and the totals of the run, without progress bars")
+	logMaxBackups := flag.Int("log-max-backups", 3, "Number of rotated log files kept")
+	var logMaxSize fs.SizeSuffix
+	flag.Var(&logMaxSize, "log-max-size", "Rotate the log file once it grows past this size")
+	progressMode := flag.String("progress", "per-file", "Progress bars: per-file, total for a single bar over all files, or both for per-file bars and a summary line of all files every -progress-interval")
+	progressInterval := flag.Duration("progress-interval", 30*time.Second, "Time between the summary lines of -progress both")
+	progressSocket := flag.String("progress-socket", "", "Write progress events as JSON lines to this named pipe or Unix socket")
+	skipLocked := flag.Bool("skip-locked", false, "Skip lock, temporary and empty files")
+	stableWait := flag.Duration("stable-wait", 0, "Skip files whose size or modification time change within this duration")
+	runRetries := flag.Int("run-retries", 0, "Run the upload again up to this many times while some files fail")
+	routeByMime := flag.String("route-by-mime", "", "Comma separated mime prefix=folder pairs sorting files into folders under the destination")
+	includeSourceDir := flag.Bool("include-source-dir", false, "Upload a directory into a folder of the same name inside the destination")
+	flattenSingleFile := flag.Bool("flatten-single-file", false, "With -include-source-dir, put a directory holding a single file directly in the destination")
+	keepSession := flag.Bool("keep-session", false, "Don't delete upload sessions after the file is created")
+	sessionKey := flag.String("session-key", "name", "How upload sessions are keyed: name, content or random")
+	listCacheTTL := flag.Duration("list-cache-ttl", 0, "Age after which a cached remote directory listing is read again, 0 keeps it for the run")
+	partNameFlag := flag.String("part-name", defaultPartName, "Name template of the parts of a multi-part file, using {name}, {num} and {total}")
+	dialNetwork := flag.String("dial-network", "tcp", "Network used to connect: tcp4, tcp6 or tcp for either")
+	var bwlimit fs.BwTimetable
+	flag.Var(&bwlimit, "bwlimit", "Upload bandwidth limit, either a size like 2M or a timetable like \"08:00,512k 20:00,off\"")
+	minSpeedWindow := flag.Duration("min-speed-window", time.Minute, "Period over which -min-speed is measured")
+	var minSpeed fs.SizeSuffix
+	flag.Var(&minSpeed, "min-speed", "Fail a file whose upload speed stays below this many bytes per second for -min-speed-window")
+	var maxFileSize fs.SizeSuffix
+	flag.Var(&maxFileSize, "max-file-size", "Split files larger than this into several remote files")
+	envFile := flag.String("env-file", configFile, "File the configuration variables are loaded from")
+	dbPath := flag.String("db", "", "Record each run and the result of its files in this SQLite database")
+	configFlag("api-url", "API_URL", "Url of the hosted teldrive app")
+	configFlag("session-token", "SESSION_TOKEN", "User session token")
+	configFlag("part-size", "PART_SIZE", "Size of each uploaded part")
+	configFlag("workers", "WORKERS", "Number of parts of a file uploaded at once")
+	configFlag("channel-id", "CHANNEL_ID", "Channel ID where files are saved")
+	configFlag("channel", "CHANNEL_ID", "Channel ID where files of this upload are saved, same as -channel-id")
+	configFlag("timeout", "TIMEOUT", "Time limit for each API call other than part uploads, 0 for none")
+	configFlag("part-timeout", "PART_TIMEOUT", "Time limit for uploading each part, 0 for none")
+	maxParts := flag.Int("max-parts", 8000, "Largest number of parts per file, larger files get larger parts up to MAX_PART_SIZE, 0 for no limit")
 	flag.Parse()
 
-	if *sourcePath == "" || *destDir == "" {
-		fmt.Println("Usage: ./uploader -path <file_or_directory_path> -dest <remote_directory>")
+	if *jsonOutput {
+		if *outputFormat != "" && *outputFormat != "json" {
+			Error.Fatalln("-json can't be combined with -output-format", *outputFormat)
+		}
+		*outputFormat = "json"
+	}
+	if *outputFormat == "" && *op == "list" {
+		*outputFormat = defaultListFormat()
+	}
+	if *outputFormat != "" && !validOutputFormat(*outputFormat) {
+		Error.Fatalln("invalid output format:", *outputFormat)
+	}
+	if *outputFormat == "json" || *outputFormat == "csv" {
+		// Keep stdout for the results only, so they can be parsed.
+		logToStderr()
+	}
+
+	if *logFile != "" {
+		if err := logToFile(*logFile, int64(logMaxSize), *logMaxBackups); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+
+	switch *logFormat {
+	case "text":
+	case "json":
+		logJSON()
+	default:
+		Error.Fatalln("invalid log format:", *logFormat)
+	}
+
+	if *quiet {
+		*logLevel = "error"
+	}
+	if err := setLogLevel(*logLevel, *quiet); err != nil {
+		Error.Fatalln(err)
+	}
+
+	switch *op {
+	case "upload", "benchmark", "list", "delete":
+	case "init":
+		if err := writeConfigTemplate(*envFile); err != nil {
+			Error.Fatalln(err)
+		}
+		Info.Println("wrote", *envFile)
 		return
+	case "config-check":
+		config, err := loadConfigFromEnv(*envFile)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		printConfig(os.Stdout, config)
+		return
+	default:
+		Error.Fatalln("invalid op:", *op)
+	}
+
+	if (*sourcePath == "" && flag.NArg() == 0 && *op == "upload") || *destDir == "" {
+		fmt.Println("Usage: ./uploader -path <file_or_directory_path> -dest <remote_directory> [more paths...]")
+		return
+	}
+
+	if *priority != "" && *priority != "newest" {
+		Error.Fatalln("invalid priority:", *priority)
+	}
+
+	if *update {
+		if *compareMethod != "name" && *compareMethod != "size" {
+			Error.Fatalln("-update can't be combined with -compare-method", *compareMethod)
+		}
+		*compareMethod = "size"
+	}
+	if *checksum {
+		if *compareMethod != "name" && *compareMethod != "checksum" {
+			Error.Fatalln("-checksum can't be combined with -compare-method", *compareMethod)
+		}
+		*compareMethod = "checksum"
+	}
+	if *overwrite {
+		if *compareMethod != "name" && *compareMethod != "overwrite" {
+			Error.Fatalln("-overwrite can't be combined with -compare-method", *compareMethod)
+		}
+		*compareMethod = "overwrite"
+	}
+	if *newer {
+		if *compareMethod != "name" && *compareMethod != "mtime" {
+			Error.Fatalln("-newer can't be combined with -compare-method", *compareMethod)
+		}
+		*compareMethod = "mtime"
+	}
+
+	comparator, err := newComparator(*compareMethod)
+	if err != nil {
+		Error.Fatalln(err)
 	}
 
-	config, err := loadConfigFromEnv()
+	routes, err := parseMimeRoutes(*routeByMime)
+	if err != nil {
+		Error.Fatalln(err)
+	}
+
+	if *category != "" && !validCategory(*category) {
+		Error.Fatalln("invalid category:", *category)
+	}
+
+	pathFilter, err := newPathFilter(*include, *exclude)
+	if err != nil {
+		Error.Fatalln(err)
+	}
 
+	extTags, err := parseExtTags(*extTagsFlag)
 	if err != nil {
 		Error.Fatalln(err)
 	}
 
-	authCookie := &http.Cookie{
-		Name:  "user-session",
-		Value: config.SessionToken,
+	if *progressMode != "per-file" && *progressMode != "total" && *progressMode != "both" {
+		Error.Fatalln("invalid progress mode:", *progressMode)
+	}
+	if *progressMode == "both" && *progressInterval <= 0 {
+		Error.Fatalln("invalid progress interval:", *progressInterval)
 	}
 
-	ctx := context.Background()
+	switch *sessionKey {
+	case "name", "content", "random":
+	default:
+		Error.Fatalln("invalid session key mode:", *sessionKey)
+	}
 
-	httpClient := rest.NewClient(http.DefaultClient).SetRoot(config.ApiURL).SetCookie(authCookie)
+	if !strings.Contains(*partNameFlag, "{num}") {
+		Error.Fatalln("-part-name must contain {num}:", *partNameFlag)
+	}
 
-	pacer := fs.NewPacer(ctx, pacer.NewDefault(pacer.MinSleep(400*time.Millisecond),
-		pacer.MaxSleep(5*time.Second), pacer.DecayConstant(2), pacer.AttackConstant(0)))
+	if *maxDepth < -1 {
+		Error.Fatalln("invalid max depth:", *maxDepth)
+	}
+	if *maxParts < 0 {
+		Error.Fatalln("invalid max parts:", *maxParts)
+	}
+	if *walkers < 1 {
+		Error.Fatalln("invalid walkers:", *walkers)
+	}
+	if *walkers > 1 && (*startAfter != "" || *flatten) {
+		// Both depend on files being found in walk order.
+		Error.Fatalln("-walkers can't be used with -start-after or -flatten")
+	}
+	if err := checkSanitizeChar(*sanitizeChar); err != nil {
+		Error.Fatalln(err)
+	}
+	if *lock && *lockStale <= 0 {
+		Error.Fatalln("invalid lock stale age:", *lockStale)
+	}
+	if minSpeed > 0 && *minSpeedWindow < time.Second {
+		// The speed is sampled once per second.
+		Error.Fatalln("invalid min speed window, it must be at least 1s:", *minSpeedWindow)
+	}
+
+	sourcePaths := flag.Args()
+	if *sourcePath != "" {
+		sourcePaths = append([]string{*sourcePath}, sourcePaths...)
+	}
+	if slices.Contains(sourcePaths, stdinPath) {
+		if len(sourcePaths) > 1 {
+			Error.Fatalln("standard input can't be combined with other sources")
+		}
+		if err := checkRemoteName(*remoteName); err != nil {
+			Error.Fatalf("%v for standard input", err)
+		}
+	} else if *remoteName != "" {
+		if err := checkRemoteName(*remoteName); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *remoteName != "" && len(sourcePaths) > 1 {
+		Error.Fatalln("-name can't be used with several sources")
+	}
+
+	config, err := loadConfigFromEnv(*envFile)
+
+	if err != nil {
+		Error.Fatalln(err)
+	}
+
+	if *channelBalance && len(config.ChannelIDs) == 0 {
+		Error.Fatalln("channel-balance requires CHANNEL_IDS to be set")
+	}
+
+	*destDir = remotePath(config.RemoteRoot, *destDir)
+
+	if len(config.RetryCodes) > 0 {
+		retryErrorCodes = config.RetryCodes
+	}
+
+	ctx := interruptContext(*maxDuration)
+
+	client, err := newHTTPClient(*dialNetwork)
+	if err != nil {
+		Error.Fatalln(err)
+	}
+
+	httpClient := rest.NewClient(client).SetRoot(config.ApiURL).SetErrorHandler(errorHandler)
+	if config.AuthMode == "bearer" {
+		httpClient.SetHeader("Authorization", "Bearer "+config.BearerToken)
+	} else {
+		httpClient.SetCookie(&http.Cookie{
+			Name:  "user-session",
+			Value: config.SessionToken,
+		})
+	}
+
+	pacer := newPacer(ctx, config)
+
+	workers := partWorkers(config.Workers)
 
 	uploader := &Uploader{
-		http:       httpClient,
-		numWorkers: config.Workers,
-		channelID:  config.ChannelID,
-		partSize:   int64(config.PartSize),
-		pacer:      pacer,
-		ctx:        ctx,
+		http:           httpClient,
+		numWorkers:     workers,
+		channelID:      config.ChannelID,
+		partSize:       int64(config.PartSize),
+		maxPartSize:    int64(config.MaxPartSize),
+		maxParts:       int64(*maxParts),
+		pacer:          pacer,
+		ctx:            ctx,
+		priority:       *priority,
+		maxFileSize:    int64(maxFileSize),
+		strict:         *strict,
+		keepSession:    *keepSession,
+		sessionKeyMode: *sessionKey,
+		partNaming:     *partNameFlag,
+		dirCache:       newListCache(*listCacheTTL),
+		quiet:          *quiet,
+		sanitize:       !*noSanitize,
+		sanitizeChar:   *sanitizeChar,
+		maxDepth:       *maxDepth,
+		walkers:        *walkers,
+		flatten:        *flatten,
+		followSymlinks: *followSymlinks,
+		sessionSalt:    newRequestID(),
+		comparator:     comparator,
+		destRoot:       *destDir,
+		routes:         routes,
+		skipLocked:     *skipLocked,
+		lockPatterns:   defaultLockPatterns,
+		stableWait:     *stableWait,
+		verifyChannel:  *verifyChannel,
+		rampUpDuration: *rampUpDuration,
+		runStart:       time.Now(),
+		stateDir:       *stateDir,
+		category:       *category,
+		tags:           parseTags(*tags),
+		extTags:        extTags,
+		fileWorkers:    config.FileWorkers,
+		partSlots:      make(chan struct{}, workers),
+		dryRun:         *dryRun,
+		maxClockSkew:   *maxClockSkew,
+		selectCommand:  *selectCommand,
+		selectTimeout:  *selectTimeout,
+		verify:         *verify,
+		hashing:        *hashFiles,
+		ioRetries:      *ioRetries,
+		filter:         pathFilter,
+		minSpeed:       int64(minSpeed),
+		minSpeedWindow: *minSpeedWindow,
+		timeout:        config.Timeout,
+		partTimeout:    config.PartTimeout,
+		bearerAuth:     config.AuthMode == "bearer",
+	}
+
+	uploader.rampUp(uploader.partSlots)
+
+	if config.RefreshURL != "" {
+		uploader.refresher = &sessionRefresher{
+			url:        config.RefreshURL,
+			tokenField: config.RefreshField,
+			bearer:     uploader.bearerAuth,
+		}
+	}
+
+	if len(config.LockPatterns) > 0 {
+		uploader.lockPatterns = config.LockPatterns
+	}
+
+	if *progressSocket != "" {
+		uploader.progress = newProgressSink(*progressSocket)
+		defer uploader.progress.close()
+	}
+
+	if len(bwlimit) > 0 {
+		uploader.bandwidth = newBandwidthLimiter(bwlimit)
+		go uploader.bandwidth.run(ctx)
+	}
+
+	if *channelBalance {
+		uploader.balancer = newChannelBalancer(config.ChannelIDs)
+	}
+
+	if *startAfter != "" {
+		uploader.startAfter = filepath.ToSlash(filepath.Clean(*startAfter))
+	}
+
+	if *checkAuth {
+		token := config.SessionToken
+		if config.AuthMode == "bearer" {
+			token = config.BearerToken
+		}
+		if err := uploader.checkToken(token); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+
+	if *op == "list" {
+		files, err := uploader.list(*destDir)
+		if err != nil {
+			Error.Fatalf("listing %s: %v", remotePath(*destDir), err)
+		}
+		if err := renderListing(os.Stdout, *outputFormat, files); err != nil {
+			Error.Fatalln(err)
+		}
+		return
 	}
 
-	err = uploader.createRemoteDir(*destDir)
+	if *op == "delete" {
+		if err := uploader.remove(*destDir, *recursive); err != nil {
+			Error.Fatalln(err)
+		}
+		return
+	}
+
+	if channels := uploadChannels(config, *channelBalance); len(channels) > 0 {
+		if err := uploader.checkChannels(channels); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+
+	if err := uploader.checkRemoteDir(*destDir); err != nil {
+		Error.Fatalln(err)
+	}
+
+	err = uploader.createRemoteDirAll(*destDir)
 
 	if err != nil {
 		Error.Fatalln(err)
 	}
 
-	if fileInfo, err := os.Stat(*sourcePath); err == nil {
-		if fileInfo.IsDir() {
-			err := uploader.uploadFilesInDirectory(*sourcePath, *destDir)
+	if *probe {
+		probeDir := remotePath(*destDir)
+		// Directories aren't created in a dry run, so the probe goes to
+		// the closest one that exists.
+		if *dryRun {
+			probeDir, err = uploader.existingDir(probeDir)
 			if err != nil {
-				Error.Println("upload failed:", err)
+				Error.Fatalln(err)
 			}
-		} else {
-			if err := uploader.uploadFile(*sourcePath, *destDir); err != nil {
-				Error.Println("upload failed:", err)
+			if probeDir != remotePath(*destDir) {
+				Info.Println("dry run: probing", probeDir, "as", remotePath(*destDir), "doesn't exist yet")
 			}
 		}
-	} else {
-		Error.Fatalln(err)
+		if err := uploader.probeWrite(probeDir); err != nil {
+			Error.Fatalln("write probe failed:", err)
+		}
+		Info.Println("write probe succeeded:", probeDir)
+	}
+
+	if *op == "benchmark" {
+		if err := uploader.benchmark(os.Stdout, *destDir, int64(benchmarkSize)); err != nil {
+			Error.Fatalln(err)
+		}
+		return
+	}
+
+	// Files are read from the paths below, names are what is reported.
+	// The exits below skip deferred calls, so the copy of standard input is
+	// removed before each of them.
+	sourceNames := append([]string(nil), sourcePaths...)
+	removeStdin := func() {}
+	for i, path := range sourcePaths {
+		if path != stdinPath {
+			continue
+		}
+		buffered, remove, err := bufferStdin(*remoteName)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		removeStdin = remove
+		sourcePaths[i] = buffered
+	}
+	defer removeStdin()
+
+	// Directories among several sources always keep their own folder, so
+	// that their trees aren't merged in the destination.
+	wrap := *includeSourceDir || len(sourcePaths) > 1
+
+	var sources []*uploadSource
+	var unreadable, allResults []UploadResult
+	for i, path := range sourcePaths {
+		src, err := uploader.prepareSource(path, sourceNames[i], *destDir, wrap, *flattenSingleFile)
+		if err != nil {
+			if len(sourcePaths) == 1 {
+				removeStdin()
+				Error.Fatalln(err)
+			}
+			Error.Println("upload failed:", err)
+			unreadable = append(unreadable, UploadResult{Name: filepath.Base(path), Path: sourceNames[i], Err: err})
+			continue
+		}
+		sources = append(sources, src)
+	}
+
+	if *remoteName != "" && sourceNames[0] != stdinPath {
+		if sources[0].isDir {
+			Error.Fatalln("-name can't be used with a directory")
+		}
+		sources[0].remoteName = *remoteName
+	}
+
+	if *progressMode != "per-file" && !*dryRun && !*quiet {
+		var files, bytes int64
+		for _, src := range sources {
+			uploader.sourceRoot = src.path
+			n, size, err := uploader.countSource(src.path)
+			if err != nil {
+				removeStdin()
+				Error.Fatalln(err)
+			}
+			files += n
+			bytes += size
+		}
+		interval := time.Duration(0)
+		if *progressMode == "both" {
+			interval = *progressInterval
+		}
+		uploader.total = newTotalProgress(files, bytes, interval)
+	}
+
+	var history *sql.DB
+	if *dbPath != "" && !*dryRun {
+		history, err = openHistory(*dbPath)
+		if err != nil {
+			removeStdin()
+			Error.Fatalln(err)
+		}
+		defer history.Close()
+	}
+
+	// The lock is taken once nothing else can stop the run, as it would be
+	// left behind by an exit until it goes stale.
+	lockID := ""
+	stopLock := func() {}
+	if *lock && !*dryRun {
+		lockID, err = uploader.acquireLock(*destDir, *lockStale)
+		var locked *lockedError
+		if errors.As(err, &locked) {
+			Warning.Println("skipping upload:", err)
+			return
+		}
+		if err != nil {
+			removeStdin()
+			Error.Fatalln(err)
+		}
+		stopLock = uploader.keepLock(lockID, *lockStale)
+	}
+
+	allResults = append(allResults, unreadable...)
+
+	// failures and walkErrs hold what failed in the last attempt, errors
+	// of the walk are already logged where they happened.
+	uploaded := 0
+	authFailed := false
+	var failures []UploadResult
+	var walkErrs []error
+	pending := sources
+	for attempt := 0; ; attempt++ {
+		// Only sources with failures are uploaded again, as single files
+		// are not checked for existing remote copies.
+		var retry []*uploadSource
+		failures = append([]UploadResult(nil), unreadable...)
+		walkErrs = nil
+		for _, src := range pending {
+			if ctx.Err() != nil {
+				break
+			}
+			results, err := uploader.uploadSource(src)
+			allResults = append(allResults, results...)
+
+			sourceFailed := err != nil
+			if err != nil {
+				walkErrs = append(walkErrs, err)
+			}
+			for _, result := range results {
+				if errors.Is(result.Err, ErrAuth) {
+					authFailed = true
+				}
+				if result.Err != nil {
+					failures = append(failures, result)
+					sourceFailed = true
+				} else {
+					uploaded++
+				}
+			}
+			if sourceFailed {
+				retry = append(retry, src)
+			}
+			// Every further call would be rejected the same way.
+			if authFailed {
+				break
+			}
+		}
+
+		if len(retry) == 0 || attempt >= *runRetries || ctx.Err() != nil || authFailed {
+			if *runRetries > 0 {
+				Summary.Printf("uploaded %d files in %d runs, %d failed", uploaded, attempt+1, len(failures))
+			}
+			break
+		}
+		pending = retry
+
+		delay := min(runRetryDelay<<min(attempt, 5), maxRunRetryDelay)
+		Warning.Printf("%d uploads failed, retrying in %v (%d/%d)", len(failures), delay, attempt+1, *runRetries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+
+	if len(sourcePaths) > 1 {
+		Summary.Printf("uploaded %d files from %d sources, %d failed", uploaded, len(sourcePaths), len(failures))
+	}
+
+	uploader.total.finish()
+
+	if lockID != "" {
+		stopLock()
+		if err := uploader.deleteFile(lockID); err != nil {
+			Error.Println("removing lock failed:", err)
+		}
+	}
+
+	if history != nil {
+		if err := recordRun(history, uploader.runStart, strings.Join(sourceNames, " "), *destDir, allResults); err != nil {
+			Error.Println("recording run failed:", err)
+		}
+	}
+
+	if *outputFormat != "" {
+		if err := renderResults(os.Stdout, *outputFormat, allResults); err != nil {
+			Error.Println(err)
+		}
+	}
+
+	removeStdin()
+
+	if errors.Is(context.Cause(ctx), errMaxDuration) {
+		Error.Fatalln("upload stopped after -max-duration", *maxDuration)
+	}
+	if ctx.Err() != nil {
+		Error.Fatalln("upload interrupted")
+	}
+
+	if n := reportFailures(failures, walkErrs); n > 0 {
+		Error.Fatalf("%d uploads failed", n)
 	}
 
-	Info.Println("Uploads complete!")
+	Summary.Println("Uploads complete!")
 }
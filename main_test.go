@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/lib/rest"
+	"golang.org/x/time/rate"
+)
+
+// newTestUploader returns an uploader calling the API served by handler.
+func newTestUploader(t *testing.T, ctx context.Context, handler http.Handler) *Uploader {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := newHTTPClient("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Frees the connections' descriptors before the next test.
+	t.Cleanup(client.CloseIdleConnections)
+	config := &Config{
+		PacerMin:   time.Millisecond,
+		PacerMax:   10 * time.Millisecond,
+		PacerDecay: 2,
+	}
+	return &Uploader{
+		http:     rest.NewClient(client).SetRoot(server.URL).SetErrorHandler(errorHandler),
+		pacer:    newPacer(ctx, config),
+		ctx:      ctx,
+		dirCache: newListCache(0),
+	}
+}
+
+func TestUploadPartRedirect(t *testing.T) {
+	for _, status := range []int{http.StatusTemporaryRedirect, http.StatusPermanentRedirect} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			data := bytes.Repeat([]byte("part"), 1024)
+			var gotLength int64
+			var gotBody []byte
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api/uploads/1", func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				http.Redirect(w, r, "/node/1?"+r.URL.RawQuery, status)
+			})
+			mux.HandleFunc("/node/1", func(w http.ResponseWriter, r *http.Request) {
+				gotLength = r.ContentLength
+				gotBody, _ = io.ReadAll(r.Body)
+				json.NewEncoder(w).Encode(UploadPartOut{PartNo: 1, Size: int64(len(gotBody))})
+			})
+			u := newTestUploader(t, context.Background(), mux)
+
+			// Hides the bytes.Reader, which the client could rewind by itself.
+			open := func() (io.Reader, error) { return struct{ io.Reader }{bytes.NewReader(data)}, nil }
+			part, err := u.uploadPart(u.ctx, "/api/uploads/1", "file", 0, 1, 1, open, int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotLength != int64(len(data)) {
+				t.Errorf("redirected request has Content-Length %d, want %d", gotLength, len(data))
+			}
+			if !bytes.Equal(gotBody, data) {
+				t.Errorf("redirected request has a body of %d bytes, want the %d bytes of the part", len(gotBody), len(data))
+			}
+			if part.Size != int64(len(data)) {
+				t.Errorf("part size %d, want %d", part.Size, len(data))
+			}
+		})
+	}
+}
+
+func TestUploadCancelledMidPart(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "file")
+	data := bytes.Repeat([]byte("x"), 4<<20)
+	if err := os.WriteFile(filePath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Parts are held until the client goes away.
+	started := make(chan struct{}, 4)
+	var inFlight int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			return
+		}
+		atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		started <- struct{}{}
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	u := newTestUploader(t, ctx, mux)
+	u.partSlots = make(chan struct{}, 2)
+	u.quiet = true
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	// The upload returns once its part goroutines are done.
+	begin := time.Now()
+	_, err := u.uploadRangeOnce(filePath, "file", "application/octet-stream", "/", 0, 0, int64(len(data)), 1<<20)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Errorf("upload returned %v after the cancel", elapsed)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&inFlight) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&inFlight); n != 0 {
+		t.Errorf("%d part requests still in flight", n)
+	}
+}
+
+func TestProgressReaderWaitAboveBurst(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Limit(1<<30), 4)
+	pr := &ProgressReader{Limiter: limiter}
+
+	// As if the burst was lowered after the read was sized by it.
+	if err := pr.wait(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSkipBeforeStart(t *testing.T) {
+	// Entries in walk order, directories ending in a slash.
+	walk := []string{"a.txt", "b/", "b/x.txt", "b/y.txt", "c/", "c/z.txt", "d.txt"}
+	tests := []struct {
+		startAfter string
+		want       []string
+	}{
+		{"a.txt", []string{"b/x.txt", "b/y.txt", "c/z.txt", "d.txt"}},
+		{"b/x.txt", []string{"b/y.txt", "c/z.txt", "d.txt"}},
+		// Deleted since.
+		{"b/w.txt", []string{"b/x.txt", "b/y.txt", "c/z.txt", "d.txt"}},
+		{"b/xx.txt", []string{"b/y.txt", "c/z.txt", "d.txt"}},
+		{"bb.txt", []string{"c/z.txt", "d.txt"}},
+		// A directory is skipped with everything in it.
+		{"b", []string{"c/z.txt", "d.txt"}},
+		{"d.txt", nil},
+		{"e.txt", nil},
+	}
+	for _, test := range tests {
+		u := &Uploader{startAfter: test.startAfter}
+		var got []string
+		skippedDir := ""
+		for _, entry := range walk {
+			if skippedDir != "" && strings.HasPrefix(entry, skippedDir) {
+				continue
+			}
+			isDir := strings.HasSuffix(entry, "/")
+			rel := strings.TrimSuffix(entry, "/")
+			if u.skipBeforeStart(rel, isDir) {
+				if isDir {
+					skippedDir = entry
+				}
+				continue
+			}
+			if !isDir {
+				got = append(got, rel)
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("-start-after %s uploads %q, want %q", test.startAfter, got, test.want)
+		}
+	}
+}
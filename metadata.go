@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// categories are the file categories known to teldrive.
+var categories = []string{"archive", "audio", "document", "image", "other", "video"}
+
+// validCategory reports whether category is one of the teldrive categories.
+func validCategory(category string) bool {
+	for _, c := range categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTags splits a comma separated -tags value.
+func parseTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// parseExtTags parses a -ext-tags value such as "mkv=movie,mkv=hd,jpg=photo"
+// into the tags added to files by extension. Extensions are matched without
+// the dot and ignoring case.
+func parseExtTags(value string) (map[string][]string, error) {
+	extTags := map[string][]string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		ext, tag, ok := strings.Cut(item, "=")
+		ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+		if !ok || ext == "" || tag == "" {
+			return nil, fmt.Errorf("invalid extension tag: %s", item)
+		}
+		extTags[ext] = append(extTags[ext], tag)
+	}
+	return extTags, nil
+}
+
+// fileTags returns the tags of the remote file uploaded from filePath.
+func (u *Uploader) fileTags(filePath string) []string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filePath), "."))
+	extTags := u.extTags[ext]
+	if len(extTags) == 0 {
+		return u.tags
+	}
+	return append(append([]string(nil), u.tags...), extTags...)
+}
+
+// localModTime returns the modification time of filePath in the RFC 3339
+// format of the updatedAt field, or "" to let the server set it.
+func localModTime(filePath string) string {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return ""
+	}
+	return info.ModTime().UTC().Format(time.RFC3339)
+}
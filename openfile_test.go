@@ -0,0 +1,86 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// exhaustFiles lowers the open file limit and opens files until it is
+// reached. The returned function closes them and restores the limit.
+func exhaustFiles(t *testing.T) func() {
+	t.Helper()
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Skip("can't read the open file limit:", err)
+	}
+	lowered := limit
+	lowered.Cur = 64
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Skip("can't lower the open file limit:", err)
+	}
+
+	var files []*os.File
+	for {
+		file, err := os.Open(os.DevNull)
+		if err != nil {
+			if !isFileLimitError(err) {
+				t.Fatal(err)
+			}
+			break
+		}
+		files = append(files, file)
+	}
+	return func() {
+		for _, file := range files {
+			file.Close()
+		}
+		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+	}
+}
+
+func TestOpenFileLeavesOneSlot(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(filePath, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	release := sync.OnceFunc(exhaustFiles(t))
+	// Runs before the temporary directory is removed.
+	t.Cleanup(release)
+
+	u := &Uploader{}
+	workers := make(chan struct{}, 2)
+
+	// The first two attempts fail, a third after 3s finds descriptors free.
+	go func() {
+		time.Sleep(2500 * time.Millisecond)
+		release()
+	}()
+
+	file, err := u.openFile(filePath, workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if len(workers) != 1 {
+		t.Errorf("%d of %d slots taken, want 1", len(workers), cap(workers))
+	}
+}
+
+func TestIsFileLimitError(t *testing.T) {
+	err := &os.PathError{Op: "open", Path: "file", Err: syscall.EMFILE}
+	if !isFileLimitError(err) {
+		t.Error("EMFILE is not a file limit error")
+	}
+	if isFileLimitError(errors.New("other")) {
+		t.Error("other error is a file limit error")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// resultRecord is the rendered form of an UploadResult.
+type resultRecord struct {
+	Name     string  `json:"name"`
+	Path     string  `json:"path"`
+	Size     int64   `json:"size"`
+	Parts    int     `json:"parts"`
+	Duration float64 `json:"durationSeconds"`
+	RemoteID string  `json:"remoteId,omitempty"`
+	SHA256   string  `json:"sha256,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+func newResultRecord(result UploadResult) resultRecord {
+	record := resultRecord{
+		Name:     result.Name,
+		Path:     result.Path,
+		Size:     result.Size,
+		Parts:    result.Parts,
+		Duration: result.Duration.Seconds(),
+		RemoteID: result.RemoteID,
+		SHA256:   result.SHA256,
+	}
+	if result.Err != nil {
+		record.Error = result.Err.Error()
+	}
+	return record
+}
+
+// defaultListFormat returns the -output-format of -op list when none is
+// given: table on a terminal and json when stdout is piped or redirected.
+func defaultListFormat() string {
+	info, err := os.Stdout.Stat()
+	if err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return "table"
+	}
+	return "json"
+}
+
+// validOutputFormat reports whether format is a supported -output-format.
+func validOutputFormat(format string) bool {
+	switch format {
+	case "table", "json", "csv":
+		return true
+	}
+	return false
+}
+
+// renderResults writes results to w as a table, JSON or CSV.
+func renderResults(w io.Writer, format string, results []UploadResult) error {
+	records := make([]resultRecord, 0, len(results))
+	for _, result := range results {
+		records = append(records, newResultRecord(result))
+	}
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"name", "path", "size", "parts", "duration_seconds", "remote_id", "error", "sha256"})
+		for _, r := range records {
+			cw.Write([]string{r.Name, r.Path, strconv.FormatInt(r.Size, 10), strconv.Itoa(r.Parts),
+				strconv.FormatFloat(r.Duration, 'f', 3, 64), r.RemoteID, r.Error, r.SHA256})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSIZE\tPARTS\tDURATION\tSTATUS")
+		for _, r := range records {
+			status := "ok"
+			if r.Error != "" {
+				status = "failed: " + r.Error
+			}
+			fmt.Fprintf(tw, "%s\t%v\t%d\t%.1fs\t%s\n", r.Name, fs.SizeSuffix(r.Size), r.Parts, r.Duration, status)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("invalid output format: %s", format)
+}
+
+// renderListing writes the remote files of a directory to w as a table,
+// JSON or CSV.
+func renderListing(w io.Writer, format string, files []FileInfo) error {
+	switch format {
+	case "json":
+		if files == nil {
+			files = []FileInfo{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(files)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"name", "type", "size", "updated_at", "id"})
+		for _, f := range files {
+			cw.Write([]string{f.Name, f.Type, strconv.FormatInt(f.Size, 10), f.ModTime, f.Id})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tTYPE\tSIZE\tUPDATED")
+		for _, f := range files {
+			size := "-"
+			if !isFolder(&f) {
+				size = fs.SizeSuffix(f.Size).String()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.Name, f.Type, size, f.ModTime)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("invalid output format: %s", format)
+}
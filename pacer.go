@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/pacer"
+)
+
+// jitterCalculator shortens each backoff of the wrapped calculator by a
+// random share of up to jitter, so parallel workers that were rate limited
+// together don't retry in lockstep. Waits asked for by the server with
+// Retry-After are kept as they are.
+type jitterCalculator struct {
+	pacer.Calculator
+	jitter   float64
+	minSleep time.Duration
+}
+
+func (c *jitterCalculator) Calculate(state pacer.State) time.Duration {
+	sleep := c.Calculator.Calculate(state)
+	if state.ConsecutiveRetries == 0 || c.jitter == 0 {
+		return sleep
+	}
+	if _, ok := pacer.IsRetryAfter(state.LastError); ok {
+		return sleep
+	}
+	sleep -= time.Duration(rand.Float64() * c.jitter * float64(sleep))
+	return max(sleep, c.minSleep)
+}
+
+// newPacer returns the pacer of the API calls configured by the PACER_*
+// settings of config.
+func newPacer(ctx context.Context, config *Config) *fs.Pacer {
+	calculator := pacer.NewDefault(pacer.MinSleep(config.PacerMin), pacer.MaxSleep(config.PacerMax),
+		pacer.DecayConstant(config.PacerDecay), pacer.AttackConstant(config.PacerAttack))
+	return fs.NewPacer(ctx, &jitterCalculator{
+		Calculator: calculator,
+		jitter:     config.PacerJitter,
+		minSleep:   config.PacerMin,
+	})
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultPartName is the name template of the parts of a multi-part file.
+const defaultPartName = "{name}.part.{num}"
+
+// partName names part partNo (1-based) of numParts of fileName by template.
+// {num} is zero padded to the width of numParts, at least 3 digits, so the
+// names sort in part order. The server assembles by part number regardless.
+func partName(template, fileName string, partNo, numParts int64) string {
+	width := max(3, len(strconv.FormatInt(numParts, 10)))
+	return strings.NewReplacer(
+		"{name}", fileName,
+		"{num}", fmt.Sprintf("%0*d", width, partNo),
+		"{total}", strconv.FormatInt(numParts, 10),
+	).Replace(template)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// remotePath joins elements into a clean absolute remote path. Backslashes
+// are treated as separators and empty elements are ignored, so joining a
+// root with or without a trailing slash and a path with or without a
+// leading slash gives the same result. Dot elements are resolved within
+// their element, so no element climbs above the ones before it: a -dest of
+// ../x stays below REMOTE_ROOT.
+func remotePath(elem ...string) string {
+	parts := make([]string, 0, len(elem)+1)
+	parts = append(parts, "/")
+	for _, e := range elem {
+		parts = append(parts, path.Join("/", strings.ReplaceAll(e, "\\", "/")))
+	}
+	return path.Join(parts...)
+}
+
+// checkRemoteName checks that name, given by -name, is a plain file name.
+func checkRemoteName(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.Contains(name, "/") || name == "." || name == ".." {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
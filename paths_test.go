@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestRemotePath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"/a/", "/a"},
+		{"/a", "/a"},
+		{"a", "/a"},
+		{"./a", "/a"},
+		{"a//b/", "/a/b"},
+		{`a\b`, "/a/b"},
+		{"", "/"},
+		{"/", "/"},
+		{".", "/"},
+		{"../a", "/a"},
+	}
+	for _, test := range tests {
+		if got := remotePath(test.in); got != test.want {
+			t.Errorf("remotePath(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestRemotePathRoot(t *testing.T) {
+	tests := []struct {
+		root, dest string
+		want       string
+	}{
+		{"/backups", "x", "/backups/x"},
+		{"/backups/", "x", "/backups/x"},
+		{"/backups", "/x", "/backups/x"},
+		{"/backups/", "/x/", "/backups/x"},
+		{"backups", "x/y", "/backups/x/y"},
+		{"/backups", "", "/backups"},
+		{"/backups", "/", "/backups"},
+		{"", "/x", "/x"},
+		{"", "", "/"},
+		{"/", "x", "/x"},
+		{"/backups", "../x", "/backups/x"},
+		{"/backups", "a/../../x", "/backups/x"},
+		{"/backups", "..", "/backups"},
+		{"/backups", `..\x`, "/backups/x"},
+	}
+	for _, test := range tests {
+		if got := remotePath(test.root, test.dest); got != test.want {
+			t.Errorf("remotePath(%q, %q) = %q, want %q", test.root, test.dest, got, test.want)
+		}
+	}
+}
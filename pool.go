@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// filePool uploads up to a fixed number of files at once. Their parts still
+// share the part workers, so more files at once mostly helps with many small
+// files that are a single part each.
+type filePool struct {
+	slots   chan struct{}
+	queue   chan func() UploadResult
+	drained chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	results []UploadResult
+}
+
+func newFilePool(workers int) *filePool {
+	return &filePool{slots: make(chan struct{}, workers)}
+}
+
+// queueFiles makes submit queue up to size uploads instead of waiting for a
+// slot, so the walkers finding files go on reading directories while files
+// upload. Uploads still queued once ctx is done are dropped.
+func (p *filePool) queueFiles(ctx context.Context, size int) {
+	p.queue = make(chan func() UploadResult, size)
+	p.drained = make(chan struct{})
+	go func() {
+		defer close(p.drained)
+		for upload := range p.queue {
+			if ctx.Err() == nil {
+				p.start(upload)
+			}
+		}
+	}()
+}
+
+// submit runs upload once a slot is free and collects its result.
+func (p *filePool) submit(upload func() UploadResult) {
+	if p.queue != nil {
+		p.queue <- upload
+		return
+	}
+	p.start(upload)
+}
+
+func (p *filePool) start(upload func() UploadResult) {
+	p.slots <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.slots }()
+
+		result := upload()
+		p.mu.Lock()
+		p.results = append(p.results, result)
+		p.mu.Unlock()
+	}()
+}
+
+// wait waits for the submitted uploads and returns their results.
+func (p *filePool) wait() []UploadResult {
+	if p.queue != nil {
+		close(p.queue)
+		<-p.drained
+		p.queue = nil
+	}
+	p.wg.Wait()
+	return p.results
+}
+
+// uploadInPool submits the upload of filePath into destDir as name,
+// replacing the remote file replace, to pool.
+func (u *Uploader) uploadInPool(pool *filePool, filePath, name, destDir string, replace *FileInfo) {
+	pool.submit(func() UploadResult {
+		result := u.uploadFileAs(filePath, name, destDir, replace)
+		if result.Err != nil {
+			logWith(Error, logFields{File: result.Name}, "upload failed:", result.Name, result.Err)
+		} else if u.fileWorkers > 1 && !u.dryRun {
+			logWith(Info, logFields{File: result.Name, Bytes: result.Size}, "uploaded:", result.Name)
+		}
+		return result
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often progress events are sent for a file being
+// uploaded.
+const progressInterval = 500 * time.Millisecond
+
+// ProgressEvent is written as a JSON line to the -progress-socket target.
+// Event is one of "start", "progress", "done" or "failed".
+type ProgressEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	File  string    `json:"file"`
+	Bytes int64     `json:"bytes"`
+	Size  int64     `json:"size"`
+	Error string    `json:"error,omitempty"`
+}
+
+// progressSink writes progress events to a named pipe, Unix socket or file
+// from its own goroutine. Sending never blocks the upload: events are dropped
+// while the consumer is slow or not connected, and the target is reopened
+// after the consumer goes away.
+type progressSink struct {
+	path   string
+	events chan ProgressEvent
+	done   chan struct{}
+}
+
+func newProgressSink(path string) *progressSink {
+	s := &progressSink{
+		path:   path,
+		events: make(chan ProgressEvent, 256),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// openProgressTarget connects to path if it is a Unix socket, and opens it
+// for writing otherwise. Opening a named pipe waits for a reader.
+func openProgressTarget(path string) (io.WriteCloser, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		return net.Dial("unix", path)
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+func (s *progressSink) run() {
+	defer close(s.done)
+
+	var w io.WriteCloser
+	for ev := range s.events {
+		if w == nil {
+			var err error
+			if w, err = openProgressTarget(s.path); err != nil {
+				w = nil
+				continue
+			}
+		}
+		if err := json.NewEncoder(w).Encode(ev); err != nil {
+			w.Close()
+			w = nil
+		}
+	}
+	if w != nil {
+		w.Close()
+	}
+}
+
+// send queues ev unless the queue is full.
+func (s *progressSink) send(ev ProgressEvent) {
+	ev.Time = time.Now()
+	select {
+	case s.events <- ev:
+	default:
+	}
+}
+
+// close flushes the queued events, waiting at most a second.
+func (s *progressSink) close() {
+	close(s.events)
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+	}
+}
+
+// trackProgress sends a start event for a file of the given size and then
+// progress events from the byte count in done until the returned stop
+// function is called.
+func (u *Uploader) trackProgress(name string, size int64, done *int64) (stop func()) {
+	if u.progress == nil {
+		return func() {}
+	}
+
+	u.progress.send(ProgressEvent{Event: "start", File: name, Size: size})
+
+	quit := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				u.progress.send(ProgressEvent{Event: "progress", File: name, Bytes: atomic.LoadInt64(done), Size: size})
+			}
+		}
+	}()
+	return func() { close(quit) }
+}
+
+// reportResult sends the final event for an uploaded file.
+func (u *Uploader) reportResult(result UploadResult) {
+	if u.progress == nil {
+		return
+	}
+	ev := ProgressEvent{Event: "done", File: result.Name, Bytes: result.Size, Size: result.Size}
+	if result.Err != nil {
+		ev.Event = "failed"
+		ev.Error = result.Err.Error()
+	}
+	u.progress.send(ev)
+}
@@ -0,0 +1,36 @@
+package main
+
+import "time"
+
+// rampUp holds back slots of the part workers semaphore when the run
+// started less than -ramp-up-duration ago. The run starts with a single
+// worker and a held slot is freed every rampUp/(numWorkers-1), so all
+// workers are in use once the ramp-up is over.
+func (u *Uploader) rampUp(workers chan struct{}) {
+	if u.rampUpDuration <= 0 || u.numWorkers < 2 {
+		return
+	}
+
+	step := u.rampUpDuration / time.Duration(u.numWorkers-1)
+	elapsed := time.Since(u.runStart)
+	held := u.numWorkers - 1 - int(elapsed/step)
+	if held <= 0 {
+		return
+	}
+
+	for i := 0; i < held; i++ {
+		workers <- struct{}{}
+	}
+
+	go func() {
+		time.Sleep(step - elapsed%step)
+		<-workers
+
+		ticker := time.NewTicker(step)
+		defer ticker.Stop()
+		for held--; held > 0; held-- {
+			<-ticker.C
+			<-workers
+		}
+	}()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"golang.org/x/time/rate"
+)
+
+// bandwidthLimiter throttles the combined upload rate of all part readers
+// following a bandwidth timetable in the same format as rclone's --bwlimit,
+// e.g. "2M" or "08:00,512k 20:00,off".
+type bandwidthLimiter struct {
+	timetable fs.BwTimetable
+	limiter   *rate.Limiter
+	current   fs.SizeSuffix
+}
+
+func newBandwidthLimiter(timetable fs.BwTimetable) *bandwidthLimiter {
+	l := &bandwidthLimiter{
+		timetable: timetable,
+		limiter:   rate.NewLimiter(rate.Inf, 0),
+		current:   -1,
+	}
+	l.apply(time.Now())
+	return l
+}
+
+// apply sets the rate to the timetable slot in force at now.
+func (l *bandwidthLimiter) apply(now time.Time) {
+	bandwidth := l.timetable.LimitAt(now).Bandwidth.Tx
+	if bandwidth == l.current {
+		return
+	}
+	l.current = bandwidth
+
+	if bandwidth <= 0 {
+		l.limiter.SetLimit(rate.Inf)
+		Info.Println("bandwidth limit: off")
+		return
+	}
+	l.limiter.SetBurst(int(bandwidth))
+	l.limiter.SetLimit(rate.Limit(bandwidth))
+	Info.Printf("bandwidth limit: %v/s", bandwidth)
+}
+
+// run re-applies the timetable every minute until ctx is done.
+func (l *bandwidthLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.apply(now)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/lib/rest"
+)
+
+// refreshWindow is how long after a refresh further 401 responses are just
+// retried. They come from calls sent with the old token before the refresh
+// finished.
+const refreshWindow = 10 * time.Second
+
+// sessionRefresher gets a new token from REFRESH_URL when a call fails with
+// 401, so that a session expiring during a long upload doesn't fail it.
+// The refresh request is sent with the current credentials. The new token is
+// read from the user-session cookie set by the response, or else from the
+// tokenField of its JSON body.
+type sessionRefresher struct {
+	url        string
+	tokenField string
+	bearer     bool
+
+	mu        sync.Mutex
+	refreshed time.Time
+}
+
+// refresh renews the session of client unless that happened just now, and
+// reports whether the failed call should be retried.
+func (r *sessionRefresher) refresh(ctx context.Context, client *rest.Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.refreshed) < refreshWindow {
+		return true
+	}
+
+	token, err := r.fetchToken(ctx, client)
+	if err != nil {
+		Error.Println("refreshing session failed:", err)
+		return false
+	}
+	if r.bearer {
+		client.SetHeader("Authorization", "Bearer "+token)
+	} else {
+		client.SetCookie(&http.Cookie{Name: "user-session", Value: token})
+	}
+	r.refreshed = time.Now()
+	Info.Println("session refreshed")
+	return true
+}
+
+func (r *sessionRefresher) fetchToken(ctx context.Context, client *rest.Client) (string, error) {
+	opts := rest.Opts{Method: "POST", Path: r.url}
+	if strings.HasPrefix(r.url, "http://") || strings.HasPrefix(r.url, "https://") {
+		opts = rest.Opts{Method: "POST", RootURL: r.url}
+	}
+
+	resp, err := client.Call(ctx, &opts)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "user-session" && cookie.Value != "" {
+			return cookie.Value, nil
+		}
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("reading refresh response: %w", err)
+	}
+	token, _ := body[r.tokenField].(string)
+	if token == "" {
+		return "", fmt.Errorf("refresh response has no user-session cookie or %q field", r.tokenField)
+	}
+	return token, nil
+}
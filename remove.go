@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// isFolder reports whether the remote item is a directory.
+func isFolder(item *FileInfo) bool {
+	return item.Type == "folder" || item.Type == "dir"
+}
+
+// remove deletes the remote file or directory at target, like rm. A
+// directory is only deleted with recursive, after everything inside it.
+func (u *Uploader) remove(target string, recursive bool) error {
+	target = remotePath(target)
+	if target == "/" {
+		return errors.New("refusing to delete the root directory")
+	}
+
+	files, err := u.list(path.Dir(target))
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return fmt.Errorf("%s not found", target)
+	}
+	if err != nil {
+		return err
+	}
+	item := findFile(path.Base(target), files)
+	if item == nil {
+		return fmt.Errorf("%s not found", target)
+	}
+	if isFolder(item) && !recursive {
+		return fmt.Errorf("%s is a directory, use -recursive to delete it", target)
+	}
+	return u.removeItem(target, item)
+}
+
+// removeItem deletes item at itemPath, deleting the contents of a directory
+// depth first before the directory itself.
+func (u *Uploader) removeItem(itemPath string, item *FileInfo) error {
+	if isFolder(item) {
+		files, err := u.list(itemPath)
+		if err != nil {
+			return err
+		}
+		for i := range files {
+			if err := u.ctx.Err(); err != nil {
+				return err
+			}
+			if err := u.removeItem(path.Join(itemPath, files[i].Name), &files[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if u.dryRun {
+		Info.Println("would delete:", itemPath)
+		return nil
+	}
+	if err := u.deleteFile(item.Id); err != nil {
+		return fmt.Errorf("deleting %s: %w", itemPath, err)
+	}
+	Info.Println("deleted:", itemPath)
+	return nil
+}
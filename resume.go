@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// uploadState records the parts of an upload session the server has
+// accepted, so an interrupted upload continues where it stopped instead of
+// starting over. It is stored as a JSON file named after the session key.
+type uploadState struct {
+	PartSize int64  `json:"partSize"`
+	Parts    []Part `json:"parts"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// defaultStateDir returns the directory state files are kept in unless
+// -state-dir is given.
+func defaultStateDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "teldrive-upload")
+}
+
+// loadState returns the saved state of the upload session key, or an empty
+// state if there is none. State recorded with a part size other than
+// partSize is dropped, since its parts don't line up with the current part
+// boundaries.
+func (u *Uploader) loadState(key string, partSize int64) (*uploadState, error) {
+	state := &uploadState{PartSize: partSize}
+	if u.stateDir == "" {
+		return state, nil
+	}
+	state.path = filepath.Join(u.stateDir, key+".json")
+
+	data, err := os.ReadFile(state.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved uploadState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		Warning.Println("ignoring unreadable upload state:", state.path, err)
+		return state, nil
+	}
+	if saved.PartSize != partSize {
+		Warning.Printf("part size changed from %d to %d since the last run, uploading %s from the start", saved.PartSize, partSize, key)
+		return state, nil
+	}
+	state.Parts = saved.Parts
+	return state, nil
+}
+
+// uploaded returns the recorded part with the given number.
+func (s *uploadState) uploaded(partNo int) (Part, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, part := range s.Parts {
+		if part.PartNo == partNo {
+			return part, true
+		}
+	}
+	return Part{}, false
+}
+
+// add records part as uploaded and saves the state.
+func (s *uploadState) add(part Part) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Parts = append(s.Parts, part)
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// remove deletes the saved state once the file has been created.
+func (s *uploadState) remove() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// mimeRoute sends files whose mime type starts with prefix to folder, a
+// directory relative to the destination root.
+type mimeRoute struct {
+	prefix string
+	folder string
+}
+
+// parseMimeRoutes parses a -route-by-mime value such as
+// "image/=Pictures,video/=Videos". Longer prefixes are matched first.
+func parseMimeRoutes(value string) ([]mimeRoute, error) {
+	var routes []mimeRoute
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, folder, ok := strings.Cut(item, "=")
+		if !ok || prefix == "" || strings.Trim(folder, "/") == "" {
+			return nil, fmt.Errorf("invalid mime route: %s", item)
+		}
+		routes = append(routes, mimeRoute{prefix: prefix, folder: strings.Trim(folder, "/")})
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+	return routes, nil
+}
+
+// detectMimeType sniffs the mime type of filePath from its first 512 bytes.
+func detectMimeType(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return readMimeType(file)
+}
+
+// readMimeType detects the mime type from the first 512 bytes of r, or all
+// of it if r is shorter.
+func readMimeType(r io.Reader) (string, error) {
+	buffer := make([]byte, 512)
+	n, err := io.ReadFull(r, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buffer[:n]), nil
+}
+
+// routeFile returns the remote directory filePath is uploaded to and its
+// listing. Files whose mime type matches a route go to the route's folder
+// under the destination root, keeping their path below it; others stay in
+// destDir. Route directories are created and listed on first use and kept
+// in listings.
+func (u *Uploader) routeFile(filePath, destDir string, listings map[string]remoteFiles) (string, remoteFiles, error) {
+	mimeType, err := detectMimeType(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	target := destDir
+	for _, route := range u.routes {
+		if strings.HasPrefix(mimeType, route.prefix) {
+			rel := strings.TrimPrefix(remotePath(destDir), u.destRoot)
+			target = remotePath(u.destRoot, route.folder, rel)
+			break
+		}
+	}
+
+	if files, ok := listings[target]; ok {
+		return target, files, nil
+	}
+
+	if err := u.createRemoteDirAll(target); err != nil {
+		return "", nil, err
+	}
+	files, err := u.list(target)
+	if err != nil {
+		return "", nil, err
+	}
+	listings[target] = indexFiles(files)
+	return target, listings[target], nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// unsafeNameChars are the characters other than control characters that
+// are replaced in remote names. Backslashes would otherwise be taken as
+// path separators.
+const unsafeNameChars = `\:*?"<>|`
+
+// sanitizeName returns name with control characters and unsafeNameChars
+// replaced by replacement.
+func sanitizeName(name, replacement string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(unsafeNameChars, r) {
+			return []rune(replacement)[0]
+		}
+		return r
+	}, name)
+}
+
+// checkSanitizeChar checks that replacement is a single safe character.
+func checkSanitizeChar(replacement string) error {
+	runes := []rune(replacement)
+	if len(runes) != 1 || sanitizeName(replacement, "_") != replacement || replacement == "/" {
+		return fmt.Errorf("invalid sanitize character %q", replacement)
+	}
+	return nil
+}
+
+// remoteName returns the remote name of the local file or directory name,
+// sanitized unless -no-sanitize is set.
+func (u *Uploader) remoteName(name string) string {
+	if !u.sanitize {
+		return name
+	}
+	return sanitizeName(name, u.sanitizeChar)
+}
+
+// logRenamed logs that name is stored remotely as remote, if they differ.
+func logRenamed(name, remote string) {
+	if name != remote {
+		Info.Printf("storing %q as %q", name, remote)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// selectScript runs the -select-script command for filePath with the path,
+// size in bytes and modification time (RFC 3339) as arguments. Exit code 0
+// selects the file for upload and 1 leaves it out. Any other exit code, or
+// a script running longer than -select-timeout, is an error.
+func (u *Uploader) selectScript(filePath string) (bool, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(u.ctx, u.selectTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, u.selectCommand, filePath,
+		strconv.FormatInt(info.Size(), 10), info.ModTime().Format(time.RFC3339))
+	// Kept off stdout when it holds the -output-format results.
+	cmd.Stdout = logConsole
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return false, fmt.Errorf("select script timed out after %v", u.selectTimeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		Info.Println("not selected:", filePath)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("select script: %w", err)
+	}
+	return true, nil
+}
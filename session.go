@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// contentKeySize is how much of a file is hashed into its session key in
+// content mode.
+const contentKeySize = 1 << 20
+
+// sessionKey returns the id of the upload session for size bytes of filePath
+// starting at offset, uploaded as fileName into destDir.
+//
+// By default the key is derived from the name, destination and size, so a
+// file gets the same session in every run. That is not enough to tell apart
+// two different files with the same name and size uploaded to the same place
+// at once, so the "content" mode also hashes the start of the file and the
+// "random" mode salts the key with a value chosen for each run.
+func (u *Uploader) sessionKey(filePath, fileName, destDir string, offset, size int64) (string, error) {
+	hash := md5.New()
+	fmt.Fprintf(hash, "%s:%s:%d", fileName, destDir, size)
+
+	switch u.sessionKeyMode {
+	case "content":
+		file, err := os.Open(filePath)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+
+		if _, err := io.Copy(hash, io.NewSectionReader(file, offset, min(size, contentKeySize))); err != nil {
+			return "", err
+		}
+	case "random":
+		fmt.Fprintf(hash, ":%s", u.sessionSalt)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// cleanupTimeout bounds the requests removing what an interrupted run left
+// behind.
+const cleanupTimeout = 30 * time.Second
+
+// errMaxDuration is the cause of the run context being cancelled by
+// -max-duration.
+var errMaxDuration = errors.New("maximum duration reached")
+
+// interruptContext returns a context cancelled on the first SIGINT or
+// SIGTERM, or with errMaxDuration once maxDuration has passed if it isn't
+// 0. A second signal exits right away.
+func interruptContext(maxDuration time.Duration) context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		Warning.Println("interrupted, cleaning up, interrupt again to quit")
+		cancel(nil)
+		signal.Stop(signals)
+	}()
+	if maxDuration > 0 {
+		time.AfterFunc(maxDuration, func() {
+			Warning.Println("-max-duration reached, stopping the upload")
+			cancel(errMaxDuration)
+		})
+	}
+	return ctx
+}
+
+// cleanupCtx returns the context for cleanup requests, which still works
+// for a short while once u.ctx has been cancelled by a signal.
+func (u *Uploader) cleanupCtx() (context.Context, context.CancelFunc) {
+	if u.ctx.Err() == nil {
+		return u.ctx, func() {}
+	}
+	return context.WithTimeout(context.WithoutCancel(u.ctx), cleanupTimeout)
+}
+
+// discardInterrupted deletes the parts of a file uploaded before the run
+// was interrupted. Parts recorded in the resume state are kept for the next
+// run instead.
+func (u *Uploader) discardInterrupted(uploadURL string, state *uploadState) {
+	if state.path != "" && u.sessionKeyMode != "random" {
+		Info.Println("keeping uploaded parts to resume:", uploadURL)
+		return
+	}
+	if err := u.deleteUploadSession(uploadURL); err != nil {
+		Error.Println("Error:", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// uploadSource is a file or directory given on the command line.
+type uploadSource struct {
+	path  string
+	name  string
+	isDir bool
+	dest  string
+	// remoteName replaces the base name of a file source if set.
+	remoteName string
+}
+
+// prepareSource stats the source at path, shown as name, and works out the
+// remote directory it is uploaded into under destDir. With wrap a directory
+// goes into a folder of its own name, unless flattenSingle is set and it
+// holds a single file.
+func (u *Uploader) prepareSource(path, name, destDir string, wrap, flattenSingle bool) (*uploadSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	u.sourceRoot = path
+
+	src := &uploadSource{path: path, name: name, isDir: info.IsDir(), dest: destDir}
+	if src.isDir && wrap && !(flattenSingle && holdsSingleFile(path)) {
+		dirName, err := sourceDirName(path)
+		if err != nil {
+			return nil, err
+		}
+		remote := u.remoteName(dirName)
+		logRenamed(dirName, remote)
+		src.dest = remotePath(destDir, remote)
+		if err := u.createRemoteDir(src.dest); err != nil {
+			return nil, err
+		}
+	}
+	if !src.isDir && len(u.routes) > 0 {
+		src.dest, _, err = u.routeFile(path, src.dest, map[string]remoteFiles{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return src, nil
+}
+
+// uploadSource uploads src and returns the result of each of its files. An
+// error that stopped the walk of a directory is returned as well.
+func (u *Uploader) uploadSource(src *uploadSource) ([]UploadResult, error) {
+	u.sourceRoot = src.path
+
+	if !src.isDir {
+		remoteName := src.remoteName
+		if remoteName == "" {
+			remoteName = filepath.Base(src.path)
+		}
+		result := u.uploadFileAs(src.path, remoteName, src.dest, nil)
+		result.Path = src.name
+		if result.Err != nil {
+			Error.Println("upload failed:", result.Err)
+		}
+		return []UploadResult{result}, nil
+	}
+
+	u.started = false
+	if u.startAfter != "" {
+		if _, err := os.Stat(filepath.Join(src.path, filepath.FromSlash(u.startAfter))); errors.Is(err, os.ErrNotExist) {
+			Warning.Println("start-after path not found in source, starting at the file after it:", u.startAfter)
+		}
+	}
+	results, err := u.uploadFilesInDirectory(src.path, src.dest)
+	results = append(results, u.uploadQueued()...)
+	if u.startAfter != "" && !u.started {
+		Warning.Println("no files after the start-after path in source:", u.startAfter)
+	}
+	return results, err
+}
+
+// reportFailures logs a summary of the files and directories that failed
+// and returns how many there were. Joined walk errors are listed one by one.
+func reportFailures(results []UploadResult, walkErrs []error) int {
+	var errs []error
+	for _, result := range results {
+		errs = append(errs, fmt.Errorf("%s: %w", result.Path, result.Err))
+	}
+	for _, err := range walkErrs {
+		errs = append(errs, splitErrors(err)...)
+	}
+
+	if len(errs) > 0 {
+		Error.Println("failed uploads:")
+	}
+	for _, err := range errs {
+		Error.Printf("  %v", err)
+	}
+	return len(errs)
+}
+
+// splitErrors returns the errors joined into err with errors.Join.
+func splitErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	var errs []error
+	for _, err := range joined.Unwrap() {
+		errs = append(errs, splitErrors(err)...)
+	}
+	return errs
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+var errTooSlow = errors.New("upload too slow")
+
+// watchSpeed cancels the upload of a file through cancel once fewer than
+// -min-speed bytes per second of it were sent, counted in sent, over the
+// last -min-speed-window. The file fails instead of holding up the run on a
+// stalled connection, and a later run resumes it. The returned function
+// stops watching.
+func (u *Uploader) watchSpeed(cancel context.CancelCauseFunc, sent *int64) (stop func()) {
+	if u.minSpeed <= 0 || u.minSpeedWindow <= 0 {
+		return func() {}
+	}
+
+	quit := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		samples := []int64{atomic.LoadInt64(sent)}
+		window := int(u.minSpeedWindow / time.Second)
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+
+			samples = append(samples, atomic.LoadInt64(sent))
+			if len(samples) <= window {
+				continue
+			}
+			samples = samples[len(samples)-window-1:]
+
+			speed := (samples[window] - samples[0]) / int64(window)
+			if speed < u.minSpeed {
+				cancel(fmt.Errorf("%w: %v/s over the last %v", errTooSlow, fs.SizeSuffix(speed), u.minSpeedWindow))
+				return
+			}
+		}
+	}()
+	return func() { close(quit) }
+}
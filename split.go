@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// manifestSuffix is appended to the name of a split file to name its manifest.
+const manifestSuffix = ".manifest.json"
+
+// SplitManifest records how a file larger than the maximum file size was
+// stored as several remote files, so it can be reassembled.
+type SplitManifest struct {
+	Name     string       `json:"name"`
+	Size     int64        `json:"size"`
+	MimeType string       `json:"mimeType"`
+	Pieces   []SplitPiece `json:"pieces"`
+}
+
+type SplitPiece struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// uploadSplit uploads filePath as consecutive remote files fileName.000,
+// fileName.001, ... each no larger than the maximum file size, followed by a
+// manifest describing them. The manifest is written last so that its
+// presence marks the split upload as complete.
+func (u *Uploader) uploadSplit(filePath, fileName, mimeType, destDir string, channelID, fileSize int64) (*FileInfo, error) {
+	manifest := SplitManifest{
+		Name:     fileName,
+		Size:     fileSize,
+		MimeType: mimeType,
+	}
+
+	for offset := int64(0); offset < fileSize; offset += u.maxFileSize {
+		size := u.maxFileSize
+		if offset+size > fileSize {
+			size = fileSize - offset
+		}
+
+		piece := SplitPiece{
+			Name:   fmt.Sprintf("%s.%03d", fileName, len(manifest.Pieces)),
+			Offset: offset,
+			Size:   size,
+		}
+
+		info, err := u.uploadRange(filePath, piece.Name, mimeType, destDir, channelID, offset, size)
+		if err != nil {
+			return nil, err
+		}
+		if u.hashing {
+			piece.SHA256 = info.Hash
+		}
+		manifest.Pieces = append(manifest.Pieces, piece)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return u.uploadBytes(fileName+manifestSuffix, "application/json", destDir, channelID, data)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// stdinPath is the -path that reads the file from standard input.
+const stdinPath = "-"
+
+// bufferStdin copies standard input into a file called name in a new
+// temporary directory. The size of a stream isn't known until it ends, so
+// it is buffered to be split into parts like any other file. remove deletes
+// the directory again.
+func bufferStdin(name string) (path string, remove func(), err error) {
+	if err := checkRemoteName(name); err != nil {
+		return "", nil, fmt.Errorf("%w for standard input", err)
+	}
+
+	dir, err := os.MkdirTemp("", "teldrive-upload-")
+	if err != nil {
+		return "", nil, err
+	}
+	remove = func() { os.RemoveAll(dir) }
+
+	path = filepath.Join(dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	size, err := io.Copy(file, os.Stdin)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return "", nil, fmt.Errorf("buffering standard input: %w", err)
+	}
+
+	Info.Printf("buffered %v from standard input", fs.SizeSuffix(size))
+	return path, remove, nil
+}
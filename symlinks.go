@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// resolveSymlink returns the entry at fullPath with symbolic links resolved
+// to their target. Without -follow-symlinks links are skipped, reported by
+// a false ok.
+func (u *Uploader) resolveSymlink(fullPath string, entry os.DirEntry) (resolved os.DirEntry, ok bool, err error) {
+	if entry.Type()&fs.ModeSymlink == 0 {
+		return entry, true, nil
+	}
+	if !u.followSymlinks {
+		Info.Println("skipping symlink:", fullPath)
+		return nil, false, nil
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, false, err
+	}
+	return fs.FileInfoToDirEntry(info), true, nil
+}
+
+// enterDir records that the directory at dirPath is walked and reports
+// whether it was walked before during this walk, which happens when a
+// followed symlink points back at a directory above it or elsewhere in the
+// tree. Without -follow-symlinks every directory is walked once anyway.
+func (u *Uploader) enterDir(dirPath string) (walked bool, err error) {
+	if !u.followSymlinks {
+		return false, nil
+	}
+	real, err := filepath.EvalSymlinks(dirPath)
+	if err != nil {
+		return false, err
+	}
+	u.walkMu.Lock()
+	defer u.walkMu.Unlock()
+	if u.walkedDirs[real] {
+		return true, nil
+	}
+	u.walkedDirs[real] = true
+	return false, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/lib/rest"
+)
+
+// tokenExpiryMargin is how long before it expires a session token is
+// reported by -check-auth, about the length of a long upload.
+const tokenExpiryMargin = 6 * time.Hour
+
+// tokenExpiry returns the expiry of token when it is a JWT with an exp
+// claim. Other tokens, including encrypted ones, are opaque and report false.
+func tokenExpiry(token string) (time.Time, bool) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+// checkToken checks the session token before anything is uploaded. The
+// expiry of a JWT is read from the token itself: an expired token fails,
+// unless REFRESH_URL can replace it, and one expiring within
+// tokenExpiryMargin is warned about. Every token is then tried with a
+// listing of the root directory, which fails if the server rejects it.
+func (u *Uploader) checkToken(token string) error {
+	if expiry, ok := tokenExpiry(token); ok {
+		left := time.Until(expiry).Round(time.Second)
+		switch {
+		case left <= 0 && u.refresher == nil:
+			return fmt.Errorf("session token expired at %s", expiry.Format(time.RFC3339))
+		case left <= 0:
+			Warning.Println("session token expired at", expiry.Format(time.RFC3339)+", refreshing it")
+		case left < tokenExpiryMargin && u.refresher == nil:
+			Warning.Printf("session token expires in %v, a long upload may fail before it completes", left)
+		default:
+			Info.Println("session token expires at", expiry.Format(time.RFC3339))
+		}
+	}
+
+	opts := rest.Opts{
+		Method: "GET",
+		Path:   "/api/files",
+		Parameters: url.Values{
+			"path":    []string{"/"},
+			"perPage": []string{"1"},
+			"op":      []string{"list"},
+		},
+	}
+
+	var resp *http.Response
+	err := u.pacer.Call(func() (bool, error) {
+		var err error
+		resp, err = u.callJSON(u.ctx, &opts, nil, nil)
+		return u.shouldRetry(u.ctx, resp, err)
+	})
+	if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		return fmt.Errorf("session token rejected by the server: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("checking session token: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/schollz/progressbar/v3"
+)
+
+// totalProgress tracks the bytes sent for every file of the run and how
+// many of the files are done. With -progress total it draws them as a
+// single bar, with -progress both it logs them as a summary line at an
+// interval next to the bar of each file.
+type totalProgress struct {
+	bar   *progressbar.ProgressBar
+	mu    sync.Mutex
+	files int64
+	done  int64
+	bytes int64
+	sent  int64
+	start time.Time
+	stop  chan struct{}
+}
+
+// newTotalProgress returns the progress of files of the given total size,
+// drawn as a bar, or logged every interval if interval isn't 0.
+func newTotalProgress(files, bytes int64, interval time.Duration) *totalProgress {
+	t := &totalProgress{files: files, bytes: bytes, start: time.Now(), stop: make(chan struct{})}
+	if interval > 0 {
+		go t.report(interval)
+		return t
+	}
+	t.bar = progressbar.NewOptions64(bytes,
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionEnableColorCodes(true),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionSetWidth(10),
+		progressbar.OptionThrottle(65*time.Millisecond),
+		progressbar.OptionSetDescription(t.description()),
+		progressbar.OptionSetTheme(progressbar.Theme{
+			Saucer:        "[green]=[reset]",
+			SaucerHead:    "[green]>[reset]",
+			SaucerPadding: " ",
+			BarStart:      "[",
+			BarEnd:        "]",
+		}),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionSetRenderBlankState(true))
+	return t
+}
+
+func (t *totalProgress) description() string {
+	return fmt.Sprintf("file %d of %d", min(t.done+1, t.files), t.files)
+}
+
+// hasBar reports whether the bar replaces the bars of the files.
+func (t *totalProgress) hasBar() bool {
+	return t != nil && t.bar != nil
+}
+
+// add counts n bytes sent, or taken back after a failed attempt if negative.
+func (t *totalProgress) add(n int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.sent += n
+	t.mu.Unlock()
+	if t.bar != nil {
+		t.bar.Add64(n)
+	}
+}
+
+// fileDone counts a file as done. skipped is the size of a file that wasn't
+// uploaded, which is added to the bytes so the total still reaches the end.
+func (t *totalProgress) fileDone(skipped int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done++
+	t.sent += skipped
+	if t.bar != nil {
+		t.bar.Describe(t.description())
+		t.bar.Add64(skipped)
+	}
+}
+
+// report logs a summary line every interval until finish is called. The
+// current speed is that of the last interval, the ETA is based on the
+// average speed.
+func (t *totalProgress) report(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last int64
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		t.mu.Lock()
+		sent, done := t.sent, t.done
+		t.mu.Unlock()
+
+		elapsed := time.Since(t.start)
+		current := float64(sent-last) / interval.Seconds()
+		average := float64(sent) / elapsed.Seconds()
+		last = sent
+
+		eta := "unknown"
+		if average > 0 {
+			eta = time.Duration(float64(t.bytes-sent) / average * float64(time.Second)).Round(time.Second).String()
+		}
+		Info.Printf("%v of %v sent, %d of %d files done, %v elapsed, %v/s now, %v/s average, ETA %s",
+			fs.SizeSuffix(sent), fs.SizeSuffix(t.bytes), done, t.files, elapsed.Round(time.Second),
+			fs.SizeSuffix(int64(current)), fs.SizeSuffix(int64(average)), eta)
+	}
+}
+
+func (t *totalProgress) finish() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	if t.bar != nil {
+		t.bar.Finish()
+		t.bar.Close()
+	}
+}
+
+// countSource returns the number and total size of the files under
+// sourcePath left after -include, -exclude and .uploadignore. Files linked
+// with -follow-symlinks count with the size of their target, the contents
+// of linked directories aren't counted.
+func (u *Uploader) countSource(sourcePath string) (files, bytes int64, err error) {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !info.IsDir() {
+		return 1, info.Size(), nil
+	}
+
+	rules, err := loadIgnoreFile(sourcePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = filepath.WalkDir(sourcePath, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == sourcePath {
+			return nil
+		}
+
+		if entry.Type()&os.ModeSymlink != 0 && !u.followSymlinks {
+			return nil
+		}
+		entry, _, err = u.resolveSymlink(path, entry)
+		if err != nil {
+			// Broken links fail in the walk itself.
+			return nil
+		}
+
+		rel := u.relativePath(path)
+		if u.filter.excluded(rel, entry.IsDir()) || rules.ignored(rel, entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			if u.maxDepth >= 0 && strings.Count(rel, "/")+1 > u.maxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		bytes += info.Size()
+		return nil
+	})
+	return files, bytes, err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newHTTPClient returns the client used for API calls. network selects how
+// connections are dialled: "tcp4" or "tcp6" to force IPv4 or IPv6, or "tcp"
+// to race both address families (happy eyeballs, the Go default).
+func newHTTPClient(network string) (*http.Client, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("invalid dial network: %s", network)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	return &http.Client{Transport: transport, CheckRedirect: checkRedirect}, nil
+}
+
+// maxRedirects is how many redirects a request follows.
+const maxRedirects = 10
+
+// checkRedirect logs redirects, such as part uploads sent on to a storage
+// node. Request bodies are replayed on 307 and 308 redirects through the
+// request's GetBody.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	Info.Printf("%s %s redirected to %s", req.Method, via[0].URL.Path, req.URL.Redacted())
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// walkQueueSize is the number of files found by a parallel walk that wait
+// for an upload slot before the walkers wait too.
+const walkQueueSize = 1024
+
+// walkGroup walks subdirectories in goroutines of their own, up to
+// -walkers at once including the walk that started them. A nil *walkGroup
+// walks every subdirectory in place, in walk order.
+type walkGroup struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	errs  []error
+}
+
+func newWalkGroup(walkers int) *walkGroup {
+	if walkers <= 1 {
+		return nil
+	}
+	return &walkGroup{slots: make(chan struct{}, walkers-1)}
+}
+
+// walk runs fn in a goroutine of its own if a walker is free and otherwise
+// in place, so a walker never waits for another one. The error of fn run in
+// place is returned, the errors of goroutines are returned by wait.
+func (g *walkGroup) walk(fn func() error) error {
+	if g != nil {
+		select {
+		case g.slots <- struct{}{}:
+			g.wg.Add(1)
+			go func() {
+				defer g.wg.Done()
+				defer func() { <-g.slots }()
+				if err := fn(); err != nil {
+					g.mu.Lock()
+					g.errs = append(g.errs, err)
+					g.mu.Unlock()
+				}
+			}()
+			return nil
+		default:
+		}
+	}
+	return fn()
+}
+
+// wait waits for the walks started in goroutines and returns their errors
+// joined together.
+func (g *walkGroup) wait() error {
+	if g == nil {
+		return nil
+	}
+	g.wg.Wait()
+	return errors.Join(g.errs...)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "runtime"
+
+// maxWorkers is the most part workers used at once. Thousands of them would
+// only pile up goroutines and read buffers without uploading any faster.
+const maxWorkers = 64
+
+// partWorkers returns the number of part workers for the WORKERS setting.
+// 0 picks two per CPU, as workers mostly wait on the network, and values
+// above maxWorkers are lowered to it.
+func partWorkers(configured int) int {
+	workers := configured
+	if workers == 0 {
+		workers = 2 * runtime.NumCPU()
+	}
+	if workers > maxWorkers {
+		if configured != 0 {
+			Warning.Printf("WORKERS %d is above the maximum of %d, using %d", configured, maxWorkers, maxWorkers)
+		}
+		workers = maxWorkers
+	}
+	return workers
+}